@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amounts are integer counts of base units. One coin is 10^CoinDecimals
+// units, so every amount has exactly one representation and balances add up
+// without rounding drift.
+const (
+	CoinDecimals = 6
+	UnitsPerCoin = 1_000_000
+)
+
+// ParseAmount converts a decimal coin amount such as "12.5" into base units.
+// It rejects negative values and more than CoinDecimals fractional digits.
+func ParseAmount(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("amount is empty")
+	}
+	if strings.HasPrefix(s, "-") {
+		return 0, fmt.Errorf("amount %q must not be negative", s)
+	}
+	s = strings.TrimPrefix(s, "+")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" {
+		whole = "0"
+	}
+	if !isDigits(whole) || (frac != "" && !isDigits(frac)) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if len(frac) > CoinDecimals {
+		return 0, fmt.Errorf("amount %q has more than %d decimal places", s, CoinDecimals)
+	}
+	frac += strings.Repeat("0", CoinDecimals-len(frac))
+
+	coins, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	units, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if coins > (math.MaxInt64-units)/UnitsPerCoin {
+		return 0, fmt.Errorf("amount %q is too large", s)
+	}
+	return coins*UnitsPerCoin + units, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// canonicalAmount renders an amount with all CoinDecimals digits. This is
+// the form covered by transaction signatures, and matches the "%.6f" coin
+// format used before amounts became integers.
+func canonicalAmount(units int64) string {
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/UnitsPerCoin, CoinDecimals, units%UnitsPerCoin)
+}
+
+// FormatAmount renders an amount for display, dropping trailing zeros but
+// keeping at least two decimal places.
+func FormatAmount(units int64) string {
+	s := canonicalAmount(units)
+	for strings.HasSuffix(s, "0") && len(s)-strings.Index(s, ".") > 3 {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// coinsToUnits converts a legacy floating point coin amount to base units.
+func coinsToUnits(coins float64) int64 {
+	return int64(math.Round(coins * UnitsPerCoin))
+}
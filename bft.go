@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bftMaxRounds bounds how many rounds the validators try before giving up
+// on a height.
+const bftMaxRounds = 10
+
+// Round timeouts. A round that sees no proposal or no quorum of votes in
+// time moves on; later rounds wait a little longer each.
+const (
+	bftTimeoutPropose = 300 * time.Millisecond
+	bftTimeoutVote    = 300 * time.Millisecond
+	bftTimeoutDelta   = 100 * time.Millisecond
+)
+
+// Steps of a BFT round. The proposer broadcasts a block, every validator
+// prevotes for it (or for nil), and once more than two thirds prevote for the
+// same block they precommit it. More than two thirds of precommits commit
+// the block.
+const (
+	bftPropose   = "propose"
+	bftPrevote   = "prevote"
+	bftPrecommit = "precommit"
+)
+
+// Commit is the quorum of precommit signatures that finalized a block. It is
+// stored alongside the block rather than in its header, because the
+// signatures are over the block hash.
+type Commit struct {
+	Round      int         `json:"round"`
+	Precommits []Precommit `json:"precommits"`
+}
+
+// Precommit is one validator's signed precommit for a block.
+type Precommit struct {
+	Validator string `json:"validator"`
+	Signature []byte `json:"signature"`
+}
+
+// BFT is a Tendermint-style engine for a fixed validator set. Blocks are
+// agreed on in rounds of propose, prevote and precommit, and a block is
+// final as soon as it is committed: it carries precommits from more than two
+// thirds of the validators, so no conflicting block can ever gather a
+// commit unless more than a third of them sign twice.
+//
+// There is no real network. Seal runs every validator whose key is in Keys
+// as a goroutine exchanging messages over channels. Offline lists validators
+// that are simulated as crashed and never send or receive anything.
+type BFT struct {
+	Keys    []*ecdsa.PrivateKey
+	Offline map[string]bool
+}
+
+func (e *BFT) Name() string {
+	return ConsensusBFT
+}
+
+// Difficulty is always 1. Committed blocks are final, so there is no
+// competing chain to weigh.
+func (e *BFT) Difficulty(bc *Blockchain, height int) uint32 {
+	return 1
+}
+
+func (e *BFT) BlockWork(bits uint32) *big.Int {
+	return big.NewInt(int64(bits))
+}
+
+// bftProposer returns the validator that proposes in round of height:
+// validators take turns in address order, moving on by one each round.
+func bftProposer(validators []string, height, round int) string {
+	sorted := append([]string(nil), validators...)
+	sort.Strings(sorted)
+	return sorted[(height+round)%len(sorted)]
+}
+
+// bftQuorum reports whether votes is more than two thirds of n.
+func bftQuorum(votes, n int) bool {
+	return 3*votes > 2*n
+}
+
+// bftVoteHash is what a validator signs to prevote or precommit blockHash in
+// a round. An empty blockHash is a vote for nil.
+func bftVoteHash(kind string, height, round int, blockHash string) string {
+	return calculateSHA256(fmt.Sprintf("%s|%d|%d|%s", kind, height, round, blockHash))
+}
+
+// VerifySeal checks that the block was proposed by the validator whose turn
+// it was in the block's round and that its commit holds valid precommits
+// from more than two thirds of the validators. The commit can come from a
+// later round than the proposal, when a locked validator proposed the block
+// again.
+func (e *BFT) VerifySeal(bc *Blockchain, height int) error {
+	block := bc.Chain[height]
+	validators := bc.Validators
+	if len(validators) == 0 {
+		return fmt.Errorf("chain has no validators")
+	}
+	if block.Bits != 1 {
+		return fmt.Errorf("difficulty %d does not match required difficulty 1", block.Bits)
+	}
+
+	round := block.Nonce
+	if round < 0 || round >= bftMaxRounds {
+		return fmt.Errorf("invalid round %d", round)
+	}
+	if proposer := bftProposer(validators, height, round); block.Signer != proposer {
+		return fmt.Errorf("round %d must be proposed by %s, not %s", round, formatAddress(proposer), formatAddress(block.Signer))
+	}
+	if len(block.Signature) == 0 {
+		return fmt.Errorf("block is not signed")
+	}
+	if err := verifyHashSignature(block.Signer, block.Hash, block.Signature); err != nil {
+		return fmt.Errorf("bad proposal signature: %v", err)
+	}
+
+	commit := block.Commit
+	if commit == nil {
+		return fmt.Errorf("block has no commit")
+	}
+	if commit.Round < round || commit.Round >= bftMaxRounds {
+		return fmt.Errorf("commit is for round %d, block was proposed in round %d", commit.Round, round)
+	}
+	member := make(map[string]bool, len(validators))
+	for _, v := range validators {
+		member[v] = true
+	}
+	signed := make(map[string]bool)
+	voteHash := bftVoteHash(bftPrecommit, height, commit.Round, block.Hash)
+	for _, pc := range commit.Precommits {
+		if !member[pc.Validator] {
+			return fmt.Errorf("precommit from %s, who is not a validator", formatAddress(pc.Validator))
+		}
+		if signed[pc.Validator] {
+			return fmt.Errorf("%s precommitted twice", formatAddress(pc.Validator))
+		}
+		if err := verifyHashSignature(pc.Validator, voteHash, pc.Signature); err != nil {
+			return fmt.Errorf("precommit from %s: %v", formatAddress(pc.Validator), err)
+		}
+		signed[pc.Validator] = true
+	}
+	if !bftQuorum(len(signed), len(validators)) {
+		return fmt.Errorf("commit has %d of %d precommits, needs more than two thirds", len(signed), len(validators))
+	}
+	return nil
+}
+
+// Seal runs one height of BFT consensus among the simulated validators and
+// replaces block with the committed proposal, including its commit. Each
+// round's proposer signs its own copy of block, so the committed block's
+// Signer, Nonce (the round it was first proposed in) and Hash depend on
+// which proposal won.
+func (e *BFT) Seal(ctx context.Context, bc *Blockchain, block *Block) error {
+	validators := bc.Validators
+	if len(validators) == 0 {
+		return fmt.Errorf("chain has no validators")
+	}
+	if len(e.Keys) == 0 {
+		return fmt.Errorf("no validator keys to run the network with")
+	}
+	keys := make(map[string]*ecdsa.PrivateKey)
+	for _, key := range e.Keys {
+		addr, err := addressFromKey(&key.PublicKey)
+		if err != nil {
+			return err
+		}
+		keys[addr] = key
+	}
+
+	net := newSimNetwork()
+	var nodes []*bftNode
+	for _, v := range validators {
+		if e.Offline[v] {
+			continue
+		}
+		key, ok := keys[v]
+		if !ok {
+			// Without its key the validator cannot take part.
+			continue
+		}
+		nodes = append(nodes, &bftNode{
+			key:        key,
+			address:    v,
+			validators: validators,
+			height:     len(bc.Chain),
+			template:   *block,
+			inbox:      net.join(v),
+			net:        net,
+		})
+	}
+	if !bftQuorum(len(nodes), len(validators)) {
+		return fmt.Errorf("only %d of %d validators are online, more than two thirds are needed", len(nodes), len(validators))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan Block, len(nodes))
+	var wg sync.WaitGroup
+	for _, nd := range nodes {
+		wg.Add(1)
+		go func(nd *bftNode) {
+			defer wg.Done()
+			if committed, ok := nd.run(ctx); ok {
+				results <- committed
+			}
+		}(nd)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	committed, ok := <-results
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		return fmt.Errorf("no block was committed within %d rounds", bftMaxRounds)
+	}
+	*block = committed
+	return nil
+}
+
+// bftMessage is a proposal or a vote broadcast on the simulated network.
+type bftMessage struct {
+	Kind      string
+	Round     int
+	BlockHash string
+	Validator string
+	Signature []byte
+	Block     *Block
+}
+
+// simNetwork delivers every broadcast to every validator that joined it,
+// including the sender. Inboxes are buffered generously; a message that does
+// not fit is dropped, like a lost packet.
+type simNetwork struct {
+	mu      sync.Mutex
+	inboxes []chan bftMessage
+}
+
+func newSimNetwork() *simNetwork {
+	return &simNetwork{}
+}
+
+func (n *simNetwork) join(validator string) chan bftMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	inbox := make(chan bftMessage, 1024)
+	n.inboxes = append(n.inboxes, inbox)
+	return inbox
+}
+
+func (n *simNetwork) broadcast(msg bftMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, inbox := range n.inboxes {
+		select {
+		case inbox <- msg:
+		default:
+		}
+	}
+}
+
+// bftNode is one validator taking part in consensus for a single height.
+type bftNode struct {
+	key        *ecdsa.PrivateKey
+	address    string
+	validators []string
+	height     int
+	template   Block
+	inbox      chan bftMessage
+	net        *simNetwork
+
+	proposals  map[int]*Block
+	prevotes   map[int]map[string]string // round -> validator -> block hash
+	precommits map[int]map[string]bftMessage
+
+	// The block this validator precommitted and the round it did so in. It
+	// prevotes for nothing else until a later round shows more than two
+	// thirds prevoting another block, and proposes it again on its turn.
+	locked      string
+	lockedRound int
+	lockedBlock *Block
+}
+
+// run plays rounds until a block is committed or the rounds run out.
+func (nd *bftNode) run(ctx context.Context) (Block, bool) {
+	nd.proposals = make(map[int]*Block)
+	nd.prevotes = make(map[int]map[string]string)
+	nd.precommits = make(map[int]map[string]bftMessage)
+
+	for round := 0; round < bftMaxRounds; round++ {
+		extra := time.Duration(round) * bftTimeoutDelta
+
+		if bftProposer(nd.validators, nd.height, round) == nd.address {
+			nd.propose(round)
+		}
+		if !nd.wait(ctx, bftTimeoutPropose+extra, func() bool { return nd.proposals[round] != nil }) && ctx.Err() != nil {
+			return Block{}, false
+		}
+
+		nd.unlockOnLaterPolka(round)
+		vote := ""
+		if proposal := nd.proposals[round]; proposal != nil && (nd.locked == "" || nd.locked == proposal.Hash) {
+			vote = proposal.Hash
+		}
+		nd.vote(bftPrevote, round, vote)
+
+		polka := ""
+		nd.wait(ctx, bftTimeoutVote+extra, func() bool {
+			polka = nd.tally(nd.prevotes[round])
+			return polka != "" || len(nd.prevotes[round]) == len(nd.validators)
+		})
+		if ctx.Err() != nil {
+			return Block{}, false
+		}
+
+		precommit := ""
+		if proposal := nd.proposals[round]; polka != "" && proposal != nil && proposal.Hash == polka {
+			nd.locked, nd.lockedRound, nd.lockedBlock = polka, round, proposal
+			precommit = polka
+		}
+		nd.vote(bftPrecommit, round, precommit)
+
+		decided := ""
+		nd.wait(ctx, bftTimeoutVote+extra, func() bool {
+			votes := make(map[string]string, len(nd.precommits[round]))
+			for v, msg := range nd.precommits[round] {
+				votes[v] = msg.BlockHash
+			}
+			decided = nd.tally(votes)
+			return decided != "" || len(votes) == len(nd.validators)
+		})
+		if ctx.Err() != nil {
+			return Block{}, false
+		}
+		if decided != "" && nd.proposals[round] != nil && nd.proposals[round].Hash == decided {
+			return nd.commit(round), true
+		}
+	}
+	return Block{}, false
+}
+
+// propose broadcasts this round's proposal. A locked validator proposes its
+// locked block unchanged, keeping the hash the others may be locked on, as
+// in Tendermint. Otherwise it signs a copy of the template block.
+func (nd *bftNode) propose(round int) {
+	var block Block
+	if nd.lockedBlock != nil {
+		block = *nd.lockedBlock
+	} else {
+		block = nd.template
+		block.Signer = nd.address
+		block.Nonce = round
+		block.Hash = block.calculateHash()
+		sig, err := signHash(nd.key, block.Hash)
+		if err != nil {
+			return
+		}
+		block.Signature = sig
+	}
+	sig, err := signHash(nd.key, bftVoteHash(bftPropose, nd.height, round, block.Hash))
+	if err != nil {
+		return
+	}
+	nd.net.broadcast(bftMessage{Kind: bftPropose, Round: round, BlockHash: block.Hash, Validator: nd.address, Signature: sig, Block: &block})
+}
+
+// unlockOnLaterPolka releases the lock if, in a round after the one this
+// validator locked in and before round, more than two thirds prevoted a
+// different block. Those validators cannot all be locked on ours, so holding
+// on to it could stall every later round.
+func (nd *bftNode) unlockOnLaterPolka(round int) {
+	if nd.locked == "" {
+		return
+	}
+	for r := nd.lockedRound + 1; r < round; r++ {
+		if polka := nd.tally(nd.prevotes[r]); polka != "" && polka != nd.locked {
+			nd.locked, nd.lockedBlock = "", nil
+			return
+		}
+	}
+}
+
+func (nd *bftNode) vote(kind string, round int, blockHash string) {
+	sig, err := signHash(nd.key, bftVoteHash(kind, nd.height, round, blockHash))
+	if err != nil {
+		return
+	}
+	nd.net.broadcast(bftMessage{Kind: kind, Round: round, BlockHash: blockHash, Validator: nd.address, Signature: sig})
+}
+
+// tally returns the block hash more than two thirds of the validators voted
+// for, or "" if there is none yet.
+func (nd *bftNode) tally(votes map[string]string) string {
+	counts := make(map[string]int)
+	for _, hash := range votes {
+		counts[hash]++
+	}
+	for hash, n := range counts {
+		if hash != "" && bftQuorum(n, len(nd.validators)) {
+			return hash
+		}
+	}
+	return ""
+}
+
+// wait handles incoming messages until done returns true, the timeout
+// passes or ctx is cancelled, and reports whether done was reached.
+func (nd *bftNode) wait(ctx context.Context, timeout time.Duration, done func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return false
+		case msg := <-nd.inbox:
+			nd.receive(msg)
+		}
+	}
+	return true
+}
+
+// receive records a message after checking its signature and sender.
+func (nd *bftNode) receive(msg bftMessage) {
+	if !nd.isValidator(msg.Validator) {
+		return
+	}
+	switch msg.Kind {
+	case bftPropose:
+		// A proposal is either signed by the round's proposer or, proposed
+		// again by a locked validator, by the proposer of an earlier round.
+		block := msg.Block
+		if block == nil || msg.Validator != bftProposer(nd.validators, nd.height, msg.Round) || block.Hash != msg.BlockHash {
+			return
+		}
+		if verifyHashSignature(msg.Validator, bftVoteHash(bftPropose, nd.height, msg.Round, block.Hash), msg.Signature) != nil {
+			return
+		}
+		if block.Nonce < 0 || block.Nonce > msg.Round || block.Signer != bftProposer(nd.validators, nd.height, block.Nonce) {
+			return
+		}
+		if block.PrevHash != nd.template.PrevHash {
+			return
+		}
+		if block.calculateHash() != block.Hash || verifyHashSignature(block.Signer, block.Hash, block.Signature) != nil {
+			return
+		}
+		if nd.proposals[msg.Round] == nil {
+			nd.proposals[msg.Round] = block
+		}
+
+	case bftPrevote, bftPrecommit:
+		if verifyHashSignature(msg.Validator, bftVoteHash(msg.Kind, nd.height, msg.Round, msg.BlockHash), msg.Signature) != nil {
+			return
+		}
+		if msg.Kind == bftPrevote {
+			if nd.prevotes[msg.Round] == nil {
+				nd.prevotes[msg.Round] = make(map[string]string)
+			}
+			nd.prevotes[msg.Round][msg.Validator] = msg.BlockHash
+		} else {
+			if nd.precommits[msg.Round] == nil {
+				nd.precommits[msg.Round] = make(map[string]bftMessage)
+			}
+			nd.precommits[msg.Round][msg.Validator] = msg
+		}
+	}
+}
+
+func (nd *bftNode) isValidator(addr string) bool {
+	for _, v := range nd.validators {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// commit returns the round's proposal with the precommits for it attached.
+func (nd *bftNode) commit(round int) Block {
+	block := *nd.proposals[round]
+	commit := &Commit{Round: round}
+	for v, msg := range nd.precommits[round] {
+		if msg.BlockHash == block.Hash {
+			commit.Precommits = append(commit.Precommits, Precommit{Validator: v, Signature: msg.Signature})
+		}
+	}
+	sort.Slice(commit.Precommits, func(i, j int) bool {
+		return commit.Precommits[i].Validator < commit.Precommits[j].Validator
+	})
+	block.Commit = commit
+	return block
+}
+
+// FinalizedHeight returns the height of the last block carrying a valid
+// commit, or 0 if none has one. Blocks up to that height can never be
+// reorganized away.
+func (bc *Blockchain) FinalizedHeight() int {
+	engine, ok := bc.Engine().(*BFT)
+	if !ok {
+		return 0
+	}
+	for h := len(bc.Chain) - 1; h > 0; h-- {
+		if bc.Chain[h].Commit != nil && engine.VerifySeal(bc, h) == nil {
+			return h
+		}
+	}
+	return 0
+}
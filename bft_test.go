@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestBFTSplitLockReleases starts a height where two of four validators are
+// locked on a block from round 0 that the other two never saw a quorum for.
+// The locked pair alone cannot reach a quorum and will not prevote a fresh
+// proposal, so consensus only continues if one of them proposes the locked
+// block again with its hash unchanged.
+func TestBFTSplitLockReleases(t *testing.T) {
+	keys := make(map[string]*ecdsa.PrivateKey)
+	var validators []string
+	for i := 0; i < 4; i++ {
+		key, _, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := addressFromKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[addr] = key
+		validators = append(validators, addr)
+	}
+	sort.Strings(validators)
+
+	genesis := NewBlock(1000, map[string]interface{}{"message": "test"})
+	genesis.PrevHash = zeroHash
+	genesis.Hash = genesis.calculateHash()
+	bc := &Blockchain{Chain: []Block{genesis}, Validators: validators}
+	height := len(bc.Chain)
+	newTemplate := func(timestamp int64) Block {
+		block := NewBlock(timestamp, map[string]interface{}{"transactions": []Transaction{}})
+		block.PrevHash = genesis.Hash
+		block.Bits = 1
+		block.Hash = block.calculateHash()
+		return block
+	}
+
+	// The block locked on, as proposed in round 0.
+	locked := newTemplate(2000)
+	locked.Signer = bftProposer(validators, height, 0)
+	locked.Nonce = 0
+	locked.Hash = locked.calculateHash()
+	sig, err := signHash(keys[locked.Signer], locked.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked.Signature = sig
+
+	// The validators proposing in rounds 1 and 2 hold the lock; the round 0
+	// proposer does not and offers a fresh block.
+	holders := map[string]bool{
+		bftProposer(validators, height, 1): true,
+		bftProposer(validators, height, 2): true,
+	}
+	net := newSimNetwork()
+	template := newTemplate(2001)
+	var nodes []*bftNode
+	for _, v := range validators {
+		nd := &bftNode{
+			key:        keys[v],
+			address:    v,
+			validators: validators,
+			height:     height,
+			template:   template,
+			inbox:      net.join(v),
+			net:        net,
+		}
+		if holders[v] {
+			lockedCopy := locked
+			nd.locked, nd.lockedRound, nd.lockedBlock = locked.Hash, 0, &lockedCopy
+		}
+		nodes = append(nodes, nd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	results := make(chan Block, len(nodes))
+	for _, nd := range nodes {
+		go func(nd *bftNode) {
+			committed, ok := nd.run(ctx)
+			if ok {
+				results <- committed
+			} else {
+				results <- Block{}
+			}
+		}(nd)
+	}
+
+	committed := <-results
+	if committed.Hash == "" {
+		t.Fatalf("no block was committed within %d rounds", bftMaxRounds)
+	}
+	if committed.Hash != locked.Hash {
+		t.Fatalf("committed %s, want the locked block %s", committed.Hash, locked.Hash)
+	}
+	if committed.Commit.Round == committed.Nonce {
+		t.Fatalf("expected the locked block to be committed in a later round than it was proposed in")
+	}
+	bc.Chain = append(bc.Chain, committed)
+	if err := (&BFT{}).VerifySeal(bc, height); err != nil {
+		t.Fatalf("committed block does not verify: %v", err)
+	}
+}
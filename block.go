@@ -1,57 +1,130 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
-	"strings"
-	"time"
 )
 
 type Block struct {
-	Data      map[string]interface{}
-	PrevHash  string
-	TimeStamp int64
-	Hash      string
-	Nonce     int
+	Version    uint32
+	Data       map[string]interface{}
+	PrevHash   string
+	MerkleRoot string
+	TimeStamp  int64
+	Bits       uint32
+	Hash       string
+	Nonce      int
+
+	// Seal of a proof-of-authority, proof-of-stake or BFT block: the signer's
+	// address and their signature over Hash. Empty under proof of work. From
+	// signerHeaderVersion on, the signer is part of the hashed header.
+	Signer    string
+	Signature []byte
+
+	// Precommits that finalized a BFT block. Not part of the hash.
+	Commit *Commit
 }
 
 func NewBlock(timestamp int64, data map[string]interface{}) Block {
 	b := Block{
+		Version:   BlockHeaderVersion,
 		TimeStamp: timestamp,
 		Data:      data,
 		Nonce:     0,
 	}
+	b.MerkleRoot = b.calculateMerkleRoot()
 	b.Hash = b.calculateHash()
 	return b
 }
 
-func NewGenesisBlock() Block {
-	currentTimeStamp := time.Now().Unix()
-	genesisBlock := NewBlock(currentTimeStamp, map[string]interface{}{"message": "Genesis Block"})
-	genesisBlock.PrevHash = "0"
-	return genesisBlock
+// calculateHash hashes the encoded block header. Transactions are committed
+// through the Merkle root, so a header is enough to check a block's hash. A
+// malformed header has no valid hash and yields an empty string.
+func (b *Block) calculateHash() string {
+	header, err := b.encodeHeader()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(header))
 }
 
-func (b *Block) calculateHash() string {
-	data := fmt.Sprintf("%d%v%s%d", b.TimeStamp, b.Data, b.PrevHash, b.Nonce)
-	return calculateSHA256(data)
+// merkleLeaves returns the transaction IDs committed by the block. Blocks
+// without a transaction list commit to the JSON encoding of their data
+// instead, which sorts keys and so does not depend on map order. From
+// dataLeafVersion on, any other data next to a transaction list, like the
+// genesis spec, is committed the same way as a last leaf.
+func (b *Block) merkleLeaves() []string {
+	txs, ok := b.Data["transactions"].([]Transaction)
+	if !ok {
+		data, _ := json.Marshal(b.Data)
+		return []string{calculateSHA256(string(data))}
+	}
+	leaves := make([]string, len(txs), len(txs)+1)
+	for i := range txs {
+		leaves[i] = txs[i].ID()
+	}
+	if b.Version >= dataLeafVersion && len(b.Data) > 1 {
+		rest := make(map[string]interface{}, len(b.Data)-1)
+		for k, v := range b.Data {
+			if k != "transactions" {
+				rest[k] = v
+			}
+		}
+		data, _ := json.Marshal(rest)
+		leaves = append(leaves, calculateSHA256(string(data)))
+	}
+	return leaves
 }
 
-func (b *Block) MineBlock(difficulty int) {
-	for b.Hash[:difficulty] != strings.Repeat("0", difficulty) {
-		b.Nonce++
-		b.Hash = b.calculateHash()
+func (b *Block) calculateMerkleRoot() string {
+	return merkleRoot(b.Version, b.merkleLeaves())
+}
+
+// Transactions returns the transactions stored in the block, or nil for
+// blocks that carry no transaction list (such as the genesis block).
+func (b *Block) Transactions() []Transaction {
+	txs, _ := b.Data["transactions"].([]Transaction)
+	return txs
+}
+
+// Fees returns the total fees paid by the block's transactions.
+func (b *Block) Fees() int64 {
+	var fees int64
+	for _, tx := range b.Transactions() {
+		fees += tx.Fee
+	}
+	return fees
+}
+
+// Size returns the serialized size of the block in bytes: the encoded header
+// followed by each of its transactions. This is what MaxBlockSize limits.
+func (b *Block) Size() int {
+	size := b.headerSize()
+	for _, tx := range b.Transactions() {
+		size += tx.Size()
 	}
-	fmt.Printf("Block mined: %s\n", b.Hash)
+	return size
 }
 
 func (b *Block) HasValidTransactions() (bool, error) {
+	return b.checkTransactions((*Transaction).isValid)
+}
+
+// hasValidLegacyTransactions is HasValidTransactions for blocks migrated from
+// a chain created before nonces, whose signatures cover less.
+func (b *Block) hasValidLegacyTransactions() (bool, error) {
+	return b.checkTransactions((*Transaction).isValidLegacy)
+}
+
+func (b *Block) checkTransactions(isValid func(*Transaction) (bool, error)) (bool, error) {
 	transactions, ok := b.Data["transactions"].([]Transaction)
 	if !ok {
 		return false, fmt.Errorf("no transactions found in block data")
 	}
 
 	for _, tx := range transactions {
-		valid, err := tx.isValid()
+		valid, err := isValid(&tx)
 		if err != nil {
 			return false, err
 		}
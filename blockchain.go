@@ -1,25 +1,58 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// Transaction models a chain can run. Account chains move amounts between
+// balances; UTXO chains consume and create outputs Bitcoin-style.
+const (
+	ModelAccount = "account"
+	ModelUTXO    = "utxo"
+)
+
 type Blockchain struct {
 	Chain               []Block
 	Difficulty          int
 	PendingTransactions []Transaction
-	MiningReward        float64
+	MiningReward        int64
+	Model               string
+	UTXOSet             map[string]TxOutput
+	MaxBlockSize        int
+	MaxBlockTxs         int
+	RetargetMode        string
+	TargetBlockTime     int64
+	RetargetWindow      int
+	HalvingInterval     int
+	MaxSupply           int64
+	Consensus           string
+	Signers             []string
+	GenesisStakes       map[string]int64
+	Validators          []string
+
+	engine ConsensusEngine
+	index  *stateIndex
 }
 
-func NewBlockchain(difficulty int, miningReward float64) *Blockchain {
+// NewBlockchain creates an account-model chain from the default genesis spec
+// with the given difficulty and reward.
+func NewBlockchain(difficulty int, miningReward int64) *Blockchain {
 	bc := &Blockchain{
 		Chain:               []Block{},
 		Difficulty:          difficulty,
 		PendingTransactions: []Transaction{},
 		MiningReward:        miningReward,
+		Model:               ModelAccount,
+		UTXOSet:             map[string]TxOutput{},
+		Consensus:           ConsensusPoW,
 	}
-	bc.Chain = append(bc.Chain, NewGenesisBlock())
+	genesis := DefaultGenesis()
+	genesis.Difficulty = difficulty
+	genesis.Reward = genesisAmount(miningReward)
+	bc.Chain = append(bc.Chain, genesis.Block(ModelAccount))
 	return bc
 }
 
@@ -30,42 +63,275 @@ func (bc *Blockchain) GetLatestBlock() Block {
 	return bc.Chain[len(bc.Chain)-1]
 }
 
-func (bc *Blockchain) MinePendingTransactions(miningRewardAddress string) {
-	currentTimeStamp := time.Now().Unix()
-	pendingTx := bc.PendingTransactions
-	block := NewBlock(currentTimeStamp, map[string]interface{}{"transactions": pendingTx})
+// MinePendingTransactions builds a block from the pending pool, has the
+// consensus engine seal it and returns it. The block starts with the miner's
+// reward: the block subsidy plus the fees of the transactions it includes.
+// Transactions that do not fit the block size or transaction count limits
+// stay pending. If ctx is cancelled before the block is sealed the chain and
+// pending pool are left untouched.
+func (bc *Blockchain) MinePendingTransactions(ctx context.Context, miningRewardAddress string) (Block, error) {
+	currentTimeStamp := bc.nextTimestamp()
+	height := len(bc.Chain)
+	subsidy := bc.BlockSubsidy(height)
+
+	// Leave room for the header and the reward. The reward is sized as if
+	// every pending fee were collected, which is at least as large as the
+	// reward the block ends up paying.
+	reservedBytes, reservedTxs := blockHeaderSize, 0
+	var pendingFees int64
+	for _, tx := range bc.PendingTransactions {
+		pendingFees += tx.Fee
+	}
+	if subsidy+pendingFees > 0 {
+		reward := bc.newRewardTransaction(miningRewardAddress, height, subsidy+pendingFees)
+		reservedBytes += reward.Size()
+		reservedTxs++
+	}
+	pendingTx := bc.dropInapplicable(bc.selectTransactions(reservedBytes, reservedTxs))
+
+	var fees int64
+	for _, tx := range pendingTx {
+		fees += tx.Fee
+	}
+	txs := pendingTx
+	if reward := subsidy + fees; reward > 0 {
+		txs = append([]Transaction{bc.newRewardTransaction(miningRewardAddress, height, reward)}, pendingTx...)
+	}
+
+	block := NewBlock(currentTimeStamp, map[string]interface{}{"transactions": txs})
 	block.PrevHash = bc.GetLatestBlock().Hash
-	block.Hash = block.calculateHash()
+	block.Bits = bc.NextBits()
 
-	block.MineBlock(bc.Difficulty)
+	if err := bc.Engine().Seal(ctx, bc, &block); err != nil {
+		return Block{}, err
+	}
 
-	fmt.Println("Block successfully mined!")
+	if err := bc.AddBlock(block); err != nil {
+		return Block{}, err
+	}
+	return block, nil
+}
 
+// AddBlock appends a mined block to the chain and removes the transactions
+// it includes from the pending pool. The block must build on the current
+// tip, so a block mined from an older copy of the chain can be added to a
+// newer one as long as nothing was appended in between.
+func (bc *Blockchain) AddBlock(block Block) error {
+	if block.PrevHash != bc.GetLatestBlock().Hash {
+		return fmt.Errorf("block does not build on the current tip %s", formatAddress(bc.GetLatestBlock().Hash))
+	}
 	bc.Chain = append(bc.Chain, block)
 
-	bc.PendingTransactions = []Transaction{
-		NewTransaction("", miningRewardAddress, bc.MiningReward),
+	if bc.usesUTXO() {
+		bc.applyBlockToUTXOSet(block)
+	}
+	bc.updateStateIndex()
+
+	included := make(map[string]bool)
+	for _, tx := range block.Transactions() {
+		included[tx.ID()] = true
+	}
+	remaining := []Transaction{}
+	for _, tx := range bc.PendingTransactions {
+		if !included[tx.ID()] {
+			remaining = append(remaining, tx)
+		}
 	}
+	bc.PendingTransactions = remaining
+	return nil
+}
+
+// ReplaceChain switches to a competing version of the chain if it starts
+// from the same genesis block, is valid under this chain's rules and has
+// more total work. Finalized blocks are never reorganized: the competing
+// chain must contain every block up to the finalized height. Transactions
+// from the blocks that are dropped go back into the pending pool if they are
+// still valid on the new chain. It returns the number of blocks dropped.
+func (bc *Blockchain) ReplaceChain(other *Blockchain) (int, error) {
+	if len(other.Chain) == 0 || other.Chain[0].Hash != bc.Chain[0].Hash {
+		return 0, fmt.Errorf("competing chain has a different genesis block")
+	}
+
+	candidate := *bc
+	candidate.Chain = other.Chain
+	candidate.UTXOSet = other.UTXOSet
+	candidate.PendingTransactions = nil
+	candidate.engine = nil
+	candidate.index = nil
+	if err := candidate.ValidateChain(); err != nil {
+		return 0, fmt.Errorf("competing chain is invalid: %v", err)
+	}
+	if ours, theirs := bc.TotalWork(), candidate.TotalWork(); theirs.Cmp(ours) <= 0 {
+		return 0, fmt.Errorf("competing chain has no more work than ours (%s vs %s)", theirs, ours)
+	}
+
+	fork := 1
+	for fork < len(bc.Chain) && fork < len(other.Chain) && bc.Chain[fork].Hash == other.Chain[fork].Hash {
+		fork++
+	}
+	if final := bc.FinalizedHeight(); fork <= final {
+		return 0, fmt.Errorf("competing chain replaces block %d, but blocks up to %d are final", fork, final)
+	}
+
+	requeue := []Transaction{}
+	for _, block := range bc.Chain[fork:] {
+		for _, tx := range block.Transactions() {
+			if !isCoinbase(tx) {
+				requeue = append(requeue, tx)
+			}
+		}
+	}
+	requeue = append(requeue, bc.PendingTransactions...)
+	dropped := len(bc.Chain) - fork
+
+	bc.Chain = other.Chain
+	bc.UTXOSet = other.UTXOSet
+	bc.PendingTransactions = []Transaction{}
+	for _, tx := range requeue {
+		// Already confirmed or no longer valid on the new chain.
+		bc.AddTransaction(tx)
+	}
+	return dropped, nil
+}
+
+// newRewardTransaction creates the mining reward for the block at height.
+// The height goes in the nonce so every reward has a distinct ID. On UTXO
+// chains the reward is a coinbase paying a single output.
+func (bc *Blockchain) newRewardTransaction(address string, height int, reward int64) Transaction {
+	tx := NewTransaction("", address, reward)
+	tx.Nonce = uint64(height)
+	if bc.usesUTXO() {
+		tx.Inputs = []TxInput{{TxID: "", Index: height}}
+		tx.Outputs = []TxOutput{{Address: address, Amount: reward}}
+	}
+	return tx
+}
+
+func (bc *Blockchain) usesUTXO() bool {
+	return bc.Model == ModelUTXO
 }
 
 func (bc *Blockchain) IsChainValid() bool {
+	return bc.ValidateChain() == nil
+}
+
+// ValidateChain checks every block, genesis included, and returns the first
+// problem found, including senders spending more than their balance.
+func (bc *Blockchain) ValidateChain() error {
+	_, err := bc.validPrefix()
+	return err
+}
+
+// validPrefix checks the chain block by block. It returns how many blocks
+// from the start are valid and the problem with the first one that is not.
+func (bc *Blockchain) validPrefix() (int, error) {
+	now := time.Now().Unix()
+	if err := checkGenesis(bc.Chain[0]); err != nil {
+		return 0, fmt.Errorf("block 0: %v", err)
+	}
+	state := bc.initialState()
+	for _, tx := range bc.Chain[0].Transactions() {
+		if err := state.applyTransaction(tx); err != nil {
+			return 0, fmt.Errorf("block 0: %v", err)
+		}
+	}
+
 	for i := 1; i < len(bc.Chain); i++ {
 		currentBlock := bc.Chain[i]
 		prevBlock := bc.Chain[i-1]
 
-		if valid, err := currentBlock.HasValidTransactions(); !valid || err != nil {
-			return false
+		hasValidTransactions := currentBlock.HasValidTransactions
+		if i < bc.legacyBlocks() {
+			hasValidTransactions = currentBlock.hasValidLegacyTransactions
+		}
+		if valid, err := hasValidTransactions(); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		} else if !valid {
+			return i, fmt.Errorf("block %d: invalid transactions", i)
+		}
+
+		if currentBlock.Version < minBlockHeaderVersion || currentBlock.Version > BlockHeaderVersion {
+			return i, fmt.Errorf("block %d: unsupported header version %d", i, currentBlock.Version)
+		}
+
+		if currentBlock.Version < prevBlock.Version {
+			return i, fmt.Errorf("block %d: header version %d is older than block %d's", i, currentBlock.Version, i-1)
+		}
+
+		if err := checkDuplicateTransactions(currentBlock); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		if currentBlock.MerkleRoot != currentBlock.calculateMerkleRoot() {
+			return i, fmt.Errorf("block %d: merkle root does not match transactions", i)
 		}
 
 		if currentBlock.Hash != currentBlock.calculateHash() {
-			return false
+			return i, fmt.Errorf("block %d: hash does not match contents", i)
 		}
 
 		if currentBlock.PrevHash != prevBlock.Hash {
-			return false
+			return i, fmt.Errorf("block %d: previous hash does not match block %d", i, i-1)
+		}
+
+		if err := bc.checkTimestamp(i, now); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		if err := bc.Engine().VerifySeal(bc, i); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		if err := bc.checkBlockLimits(currentBlock); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		if err := bc.checkCoinbase(i, currentBlock); err != nil {
+			return i, fmt.Errorf("block %d: %v", i, err)
+		}
+
+		for _, tx := range currentBlock.Transactions() {
+			if err := bc.checkTransactionType(tx); err != nil {
+				return i, fmt.Errorf("block %d: %v", i, err)
+			}
+			if err := state.applyTransaction(tx); err != nil {
+				return i, fmt.Errorf("block %d: %v", i, err)
+			}
+		}
+	}
+
+	if bc.usesUTXO() && !sameUTXOSet(state.utxos, bc.UTXOSet) {
+		return len(bc.Chain), fmt.Errorf("unspent output set does not match the chain")
+	}
+	return len(bc.Chain), nil
+}
+
+// checkGenesis checks the genesis block's header: it must start the chain
+// and its hash and Merkle root must match its contents, so the allocations
+// and spec it carries cannot be changed after the fact. Its transactions
+// are only premine payouts, checked by applying them.
+func checkGenesis(genesis Block) error {
+	if genesis.Version < minBlockHeaderVersion || genesis.Version > BlockHeaderVersion {
+		return fmt.Errorf("unsupported header version %d", genesis.Version)
+	}
+	if genesis.PrevHash != zeroHash {
+		return fmt.Errorf("genesis previous hash must be zero")
+	}
+	if err := checkDuplicateTransactions(genesis); err != nil {
+		return err
+	}
+	if genesis.MerkleRoot != genesis.calculateMerkleRoot() {
+		return fmt.Errorf("merkle root does not match transactions")
+	}
+	if genesis.Hash != genesis.calculateHash() {
+		return fmt.Errorf("hash does not match contents")
+	}
+	for _, tx := range genesis.Transactions() {
+		if tx.FromAddress != "" || tx.Type != "" {
+			return fmt.Errorf("genesis transactions must be premine payouts")
 		}
 	}
-	return true
+	return nil
 }
 
 func (bc *Blockchain) AddTransaction(transaction Transaction) error {
@@ -84,12 +350,103 @@ func (bc *Blockchain) AddTransaction(transaction Transaction) error {
 		return fmt.Errorf("cannot add invalid transaction to chain")
 	}
 
+	if transaction.Type != "" {
+		if err := checkTypedTransaction(transaction); err != nil {
+			return err
+		}
+		if err := bc.checkTransactionType(transaction); err != nil {
+			return err
+		}
+	} else {
+		if transaction.Amount <= 0 {
+			return fmt.Errorf("transaction amount must be positive")
+		}
+
+		if transaction.Fee < 0 {
+			return fmt.Errorf("transaction fee must not be negative")
+		}
+	}
+
+	id := transaction.ID()
+	if _, err := bc.FindPendingTransaction(id); err == nil {
+		return fmt.Errorf("transaction %s is already pending", id)
+	}
+	if _, height, _, err := bc.FindTransaction(id); err == nil {
+		return fmt.Errorf("transaction %s is already confirmed in block %d", id, height)
+	}
+
+	if size := blockHeaderSize + transaction.Size(); bc.MaxBlockSize > 0 && size > bc.MaxBlockSize {
+		return fmt.Errorf("transaction is too large to fit in any block (%d bytes with header, limit %d)", size, bc.MaxBlockSize)
+	}
+
+	if err := checkNonce(transaction, bc.GetNextNonce(transaction.FromAddress)); err != nil {
+		return err
+	}
+
+	if transaction.Type == TxTypeVote {
+		poa := bc.Engine().(*ProofOfAuthority)
+		snap, err := poa.snapshotAt(bc, len(bc.Chain))
+		if err != nil {
+			return err
+		}
+		if err := snap.checkVote(transaction); err != nil {
+			return err
+		}
+		bc.PendingTransactions = append(bc.PendingTransactions, transaction)
+		return nil
+	}
+
+	if transaction.Type != "" {
+		state, err := bc.pendingState()
+		if err != nil {
+			return err
+		}
+		if err := state.applyTransaction(transaction); err != nil {
+			return err
+		}
+		bc.PendingTransactions = append(bc.PendingTransactions, transaction)
+		return nil
+	}
+
+	if bc.usesUTXO() {
+		if err := checkUTXOTransaction(transaction, bc.UTXOSet); err != nil {
+			return err
+		}
+		pendingSpends := bc.pendingSpends()
+		for _, in := range transaction.Inputs {
+			if key := outpoint(in.TxID, in.Index); pendingSpends[key] {
+				return fmt.Errorf("double spend: output %s is already spent by a pending transaction", key)
+			}
+		}
+		bc.PendingTransactions = append(bc.PendingTransactions, transaction)
+		return nil
+	}
+
+	if len(transaction.Inputs) > 0 || len(transaction.Outputs) > 0 {
+		return fmt.Errorf("account chains do not accept transactions with inputs or outputs")
+	}
+
+	available := bc.GetSpendableBalance(transaction.FromAddress)
+	if transaction.Amount+transaction.Fee > available {
+		return fmt.Errorf("insufficient balance: %s available, %s requested", FormatAmount(available), FormatAmount(transaction.Amount+transaction.Fee))
+	}
+
 	bc.PendingTransactions = append(bc.PendingTransactions, transaction)
 	return nil
 }
 
-func (bc *Blockchain) GetBalanceOfAddress(address string) float64 {
-	balance := 0.0
+// GetBalanceOfAddress returns the address's confirmed balance. It is looked
+// up in the state index, falling back to a walk over the chain if the chain
+// cannot be indexed.
+func (bc *Blockchain) GetBalanceOfAddress(address string) int64 {
+	if bc.updateStateIndex() == nil {
+		return bc.index.state.balances[address]
+	}
+	if bc.usesUTXO() {
+		return bc.utxoBalance(address, nil)
+	}
+
+	var balance int64
 
 	transactions := []Transaction{}
 
@@ -105,13 +462,145 @@ func (bc *Blockchain) GetBalanceOfAddress(address string) float64 {
 	}
 
 	for _, tx := range transactions {
+		balance += balanceChange(tx, address)
+	}
+
+	return balance
+}
+
+// balanceChange returns how a transaction changes the address's account
+// balance. Staking moves coins out of the balance and unstaking moves them
+// back; votes and evidence only cost their fee.
+func balanceChange(tx Transaction, address string) int64 {
+	var change int64
+	switch tx.Type {
+	case TxTypeStake:
+		if tx.FromAddress == address {
+			change -= tx.Amount + tx.Fee
+		}
+	case TxTypeUnstake:
+		if tx.FromAddress == address {
+			change += tx.Amount - tx.Fee
+		}
+	case TxTypeVote, TxTypeEvidence:
 		if tx.FromAddress == address {
-			balance -= tx.Amount
+			change -= tx.Fee
+		}
+	default:
+		if tx.FromAddress == address {
+			change -= tx.Amount + tx.Fee
 		}
 		if tx.ToAddress == address {
-			balance += tx.Amount
+			change += tx.Amount
 		}
 	}
+	return change
+}
 
-	return balance
+// GetPendingOutgoing returns the total amount, including fees, the address
+// is already sending in transactions that have not been mined yet.
+func (bc *Blockchain) GetPendingOutgoing(address string) int64 {
+	var total int64
+	for _, tx := range bc.PendingTransactions {
+		if tx.FromAddress != address {
+			continue
+		}
+		if tx.Type == TxTypeUnstake {
+			// The unstaked coins only arrive once mined.
+			total += tx.Fee
+		} else {
+			total += tx.Amount + tx.Fee
+		}
+	}
+	return total
+}
+
+// GetNonce returns the nonce the address's next confirmed transaction must
+// carry, which is the number of transactions it has sent so far. It is
+// looked up in the state index, falling back to counting them in the chain
+// if the chain cannot be indexed.
+func (bc *Blockchain) GetNonce(address string) uint64 {
+	if bc.updateStateIndex() == nil {
+		return bc.index.state.nonces[address]
+	}
+	var nonce uint64
+	for _, block := range bc.Chain {
+		for _, tx := range block.Transactions() {
+			if tx.FromAddress == address {
+				nonce++
+			}
+		}
+	}
+	return nonce
+}
+
+// GetNextNonce returns the nonce for a new transaction from address, taking
+// transactions still waiting in the pending pool into account.
+func (bc *Blockchain) GetNextNonce(address string) uint64 {
+	nonce := bc.GetNonce(address)
+	for _, tx := range bc.PendingTransactions {
+		if tx.FromAddress == address {
+			nonce++
+		}
+	}
+	return nonce
+}
+
+// GetSpendableBalance returns the confirmed balance minus amounts already
+// committed to pending transactions. Incoming pending funds are not counted.
+func (bc *Blockchain) GetSpendableBalance(address string) int64 {
+	if bc.usesUTXO() {
+		return bc.utxoBalance(address, bc.pendingSpends())
+	}
+	return bc.GetBalanceOfAddress(address) - bc.GetPendingOutgoing(address)
+}
+
+// FindTransaction looks up a confirmed transaction by its ID or a unique
+// prefix of it, returning the transaction and its block and position.
+func (bc *Blockchain) FindTransaction(id string) (Transaction, int, int, error) {
+	var found Transaction
+	blockIndex, txIndex, matches := -1, -1, 0
+	for i, block := range bc.Chain {
+		for j, tx := range block.Transactions() {
+			txID := tx.ID()
+			if txID == id {
+				return tx, i, j, nil
+			}
+			if id != "" && strings.HasPrefix(txID, id) {
+				found, blockIndex, txIndex = tx, i, j
+				matches++
+			}
+		}
+	}
+	switch {
+	case matches == 0:
+		return Transaction{}, -1, -1, fmt.Errorf("transaction %s not found in the chain", id)
+	case matches > 1:
+		return Transaction{}, -1, -1, fmt.Errorf("transaction prefix %s is ambiguous", id)
+	}
+	return found, blockIndex, txIndex, nil
+}
+
+// FindPendingTransaction looks up a transaction in the pending pool by its
+// ID or a unique prefix of it.
+func (bc *Blockchain) FindPendingTransaction(id string) (Transaction, error) {
+	var found Transaction
+	matches := 0
+	for _, tx := range bc.PendingTransactions {
+		txID := tx.ID()
+		if txID == id {
+			return tx, nil
+		}
+		if id != "" && strings.HasPrefix(txID, id) {
+			found = tx
+			matches++
+		}
+	}
+	switch {
+	case matches == 0:
+		return Transaction{}, fmt.Errorf("transaction %s is not pending", id)
+	case matches > 1:
+		return Transaction{}, fmt.Errorf("transaction prefix %s is ambiguous", id)
+	}
+	return found, nil
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"testing"
+)
+
+// fundedChain returns a chain whose only mined block pays its 50 coin reward
+// to a new key's address.
+func fundedChain(t *testing.T) (*Blockchain, *ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, addr := testKey(t)
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	if _, err := bc.MinePendingTransactions(context.Background(), addr); err != nil {
+		t.Fatal(err)
+	}
+	return bc, key, addr
+}
+
+// signedTransfer returns a transfer from key's address signed with key.
+func signedTransfer(key *ecdsa.PrivateKey, from, to string, amount, fee int64, nonce uint64) Transaction {
+	tx := NewTransaction(from, to, amount)
+	tx.Fee = fee
+	tx.Nonce = nonce
+	tx.signTransaction(key)
+	return tx
+}
+
+func TestAddTransactionSpendableBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		pending []int64 // amounts already sent, without fees
+		amount  int64
+		fee     int64
+		wantErr string
+	}{
+		{name: "within the balance", amount: 40 * UnitsPerCoin, fee: UnitsPerCoin},
+		{name: "whole balance", amount: 49 * UnitsPerCoin, fee: UnitsPerCoin},
+		{
+			name:    "amount above the balance",
+			amount:  51 * UnitsPerCoin,
+			wantErr: "insufficient balance: 50.00 available, 51.00 requested",
+		},
+		{
+			name:    "fee takes it above the balance",
+			amount:  50 * UnitsPerCoin,
+			fee:     1,
+			wantErr: "50.00 available, 50.000001 requested",
+		},
+		{
+			name:    "pending transfers are already spent",
+			pending: []int64{20 * UnitsPerCoin, 10 * UnitsPerCoin},
+			amount:  25 * UnitsPerCoin,
+			wantErr: "20.00 available, 25.00 requested",
+		},
+		{
+			name:    "pending transfers leave enough",
+			pending: []int64{20 * UnitsPerCoin},
+			amount:  30 * UnitsPerCoin,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc, key, addr := fundedChain(t)
+			for i, amount := range tt.pending {
+				if err := bc.AddTransaction(signedTransfer(key, addr, "bob", amount, 0, uint64(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tx := signedTransfer(key, addr, "bob", tt.amount, tt.fee, uint64(len(tt.pending)))
+			checkErr(t, bc.AddTransaction(tx), tt.wantErr)
+		})
+	}
+}
+
+func TestAddTransactionNonces(t *testing.T) {
+	tests := []struct {
+		name      string
+		confirmed int // transfers mined before the test transaction
+		pending   int // transfers pending before it
+		nonce     uint64
+		replay    bool // resend the last confirmed transaction as is
+		wantErr   string
+	}{
+		{name: "first transfer", nonce: 0},
+		{name: "skips a nonce", nonce: 1, wantErr: "nonce 1 out of order"},
+		{name: "follows a pending transfer", pending: 1, nonce: 1},
+		{name: "reuses a pending nonce", pending: 1, nonce: 0, wantErr: "nonce 0 already used"},
+		{name: "follows a confirmed transfer", confirmed: 2, nonce: 2},
+		{name: "reuses a confirmed nonce", confirmed: 2, nonce: 1, wantErr: "nonce 1 already used"},
+		{name: "gap after confirmed transfers", confirmed: 2, pending: 1, nonce: 4, wantErr: "(next is 3)"},
+		{name: "replays a confirmed transfer", confirmed: 1, replay: true, wantErr: "already confirmed in block"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc, key, addr := fundedChain(t)
+			// Each transfer sends a different amount, so no two share an ID.
+			var last Transaction
+			for i := 0; i < tt.confirmed+tt.pending; i++ {
+				last = signedTransfer(key, addr, "bob", int64(i+1), 0, uint64(i))
+				if err := bc.AddTransaction(last); err != nil {
+					t.Fatal(err)
+				}
+				if i == tt.confirmed-1 {
+					if _, err := bc.MinePendingTransactions(context.Background(), "miner"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			tx := signedTransfer(key, addr, "bob", UnitsPerCoin, 0, tt.nonce)
+			if tt.replay {
+				tx = last
+			}
+			checkErr(t, bc.AddTransaction(tx), tt.wantErr)
+		})
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
-	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -18,6 +24,13 @@ const (
 	dataDir        = ".bloxer"
 	blockchainFile = "blockchain.json"
 	walletFile     = "wallet.json"
+	validatorsFile = "validators.json"
+	chainDir       = "chain"
+	chainMetaFile  = "meta.json"
+	pendingFile    = "pending.json"
+	stateFile      = "state.json"
+	stateLogFile   = "state.log"
+	historyFile    = "history.log"
 )
 
 // Persistence types
@@ -27,25 +40,124 @@ type WalletData struct {
 }
 
 type TransactionData struct {
-	FromAddress string  `json:"from_address"`
-	ToAddress   string  `json:"to_address"`
-	Amount      float64 `json:"amount"`
-	Signature   []byte  `json:"signature"`
+	FromAddress string     `json:"from_address"`
+	ToAddress   string     `json:"to_address"`
+	Amount      int64      `json:"amount"`
+	Fee         int64      `json:"fee,omitempty"`
+	Nonce       uint64     `json:"nonce"`
+	Timestamp   int64      `json:"timestamp"`
+	Inputs      []TxInput  `json:"inputs,omitempty"`
+	Outputs     []TxOutput `json:"outputs,omitempty"`
+	Type        string     `json:"type,omitempty"`
+	Payload     string     `json:"payload,omitempty"`
+	Signature   []byte     `json:"signature"`
 }
 
 type BlockData struct {
-	Data      map[string]interface{} `json:"data"`
-	PrevHash  string                 `json:"prev_hash"`
-	TimeStamp int64                  `json:"timestamp"`
-	Hash      string                 `json:"hash"`
-	Nonce     int                    `json:"nonce"`
+	Version    uint32                 `json:"version"`
+	Data       map[string]interface{} `json:"data"`
+	PrevHash   string                 `json:"prev_hash"`
+	MerkleRoot string                 `json:"merkle_root"`
+	TimeStamp  int64                  `json:"timestamp"`
+	Bits       uint32                 `json:"bits"`
+	Hash       string                 `json:"hash"`
+	Nonce      int                    `json:"nonce"`
+	Signer     string                 `json:"signer,omitempty"`
+	Signature  []byte                 `json:"signature,omitempty"`
+	Commit     *Commit                `json:"commit,omitempty"`
 }
 
+// BlockHeaderData holds just the fields covered by a block's hash, enough
+// to check a Merkle proof without the rest of the block.
+type BlockHeaderData struct {
+	Version    uint32 `json:"version"`
+	PrevHash   string `json:"prev_hash"`
+	MerkleRoot string `json:"merkle_root"`
+	TimeStamp  int64  `json:"timestamp"`
+	Bits       uint32 `json:"bits"`
+	Nonce      int    `json:"nonce"`
+	Hash       string `json:"hash"`
+	Signer     string `json:"signer,omitempty"`
+	Signature  []byte `json:"signature,omitempty"`
+}
+
+type MerkleProofData struct {
+	TxID   string          `json:"txid"`
+	Height int             `json:"height"`
+	Header BlockHeaderData `json:"header"`
+	Path   []MerkleStep    `json:"path"`
+}
+
+// ChainParamsData holds the settings a chain was created with. They never
+// change afterwards, so the block store writes them once.
+type ChainParamsData struct {
+	Difficulty      int              `json:"difficulty"`
+	MiningReward    int64            `json:"mining_reward"`
+	Model           string           `json:"model,omitempty"`
+	MaxBlockSize    int              `json:"max_block_size,omitempty"`
+	MaxBlockTxs     int              `json:"max_block_txs,omitempty"`
+	RetargetMode    string           `json:"retarget_mode,omitempty"`
+	TargetBlockTime int64            `json:"target_block_time,omitempty"`
+	RetargetWindow  int              `json:"retarget_window,omitempty"`
+	HalvingInterval int              `json:"halving_interval,omitempty"`
+	MaxSupply       int64            `json:"max_supply,omitempty"`
+	Consensus       string           `json:"consensus,omitempty"`
+	Signers         []string         `json:"signers,omitempty"`
+	GenesisStakes   map[string]int64 `json:"genesis_stakes,omitempty"`
+	Validators      []string         `json:"validators,omitempty"`
+}
+
+// ChainMetaData is the block store's meta file.
+type ChainMetaData struct {
+	Version int `json:"version"`
+	ChainParamsData
+}
+
+// StateIndexData is the state index snapshot: the ledger state after the
+// block with the given height and hash.
+type StateIndexData struct {
+	Version     int                 `json:"version"`
+	Height      int                 `json:"height"`
+	Hash        string              `json:"hash"`
+	Balances    map[string]int64    `json:"balances"`
+	Nonces      map[string]uint64   `json:"nonces"`
+	Stakes      map[string]int64    `json:"stakes,omitempty"`
+	Slashed     map[string]bool     `json:"slashed,omitempty"`
+	UTXOs       map[string]TxOutput `json:"utxos,omitempty"`
+	HistorySize int64               `json:"history_size"`
+}
+
+// StateDeltaData is one line of the state log: what the block with the given
+// height and hash changed in the state left by the block before it.
+type StateDeltaData struct {
+	Height      int                 `json:"height"`
+	Hash        string              `json:"hash"`
+	PrevHash    string              `json:"prev_hash"`
+	Balances    map[string]int64    `json:"balances,omitempty"`
+	Nonces      map[string]uint64   `json:"nonces,omitempty"`
+	Stakes      map[string]int64    `json:"stakes,omitempty"`
+	Slashed     []string            `json:"slashed,omitempty"`
+	Spent       []string            `json:"spent,omitempty"`
+	Created     map[string]TxOutput `json:"created,omitempty"`
+	HistorySize int64               `json:"history_size"`
+}
+
+// HistoryBlockData is one line of the history log: the address index
+// entries added by the block with the given height and hash.
+type HistoryBlockData struct {
+	Height  int                       `json:"height"`
+	Hash    string                    `json:"hash"`
+	Entries map[string][]HistoryEntry `json:"entries,omitempty"`
+}
+
+// BlockchainData is the single-file blockchain.json format used before the
+// block store, still accepted by import and migrated on first load.
 type BlockchainData struct {
-	Chain               []BlockData       `json:"chain"`
-	Difficulty          int               `json:"difficulty"`
-	PendingTransactions []TransactionData `json:"pending_transactions"`
-	MiningReward        float64           `json:"mining_reward"`
+	Version             int                 `json:"version"`
+	Chain               []BlockData         `json:"chain"`
+	PendingTransactions []TransactionData   `json:"pending_transactions"`
+	UTXOSet             map[string]TxOutput `json:"utxo_set,omitempty"`
+	ChainParamsData
 }
 
 // CLI colors and formatting
@@ -83,7 +195,7 @@ func saveWallet(privateKey *ecdsa.PrivateKey, address string) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(getDataDir(), walletFile), data, 0600)
+	return writeFileAtomic(filepath.Join(getDataDir(), walletFile), data, 0600)
 }
 
 func loadWallet() (*ecdsa.PrivateKey, string, error) {
@@ -107,6 +219,51 @@ func walletExists() bool {
 	return err == nil
 }
 
+// Validator keys for the simulated BFT network. The whole network runs in
+// one process, so all of its keys are kept together, in the wallet format.
+func saveValidatorKeys(keys []*ecdsa.PrivateKey) error {
+	if err := ensureDataDir(); err != nil {
+		return err
+	}
+	validators := make([]WalletData, len(keys))
+	for i, key := range keys {
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		address, err := addressFromKey(&key.PublicKey)
+		if err != nil {
+			return err
+		}
+		validators[i] = WalletData{PrivateKey: keyBytes, Address: address}
+	}
+	data, err := json.MarshalIndent(validators, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(getDataDir(), validatorsFile), data, 0600)
+}
+
+func loadValidatorKeys() ([]*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(filepath.Join(getDataDir(), validatorsFile))
+	if err != nil {
+		return nil, err
+	}
+	var validators []WalletData
+	if err := json.Unmarshal(data, &validators); err != nil {
+		return nil, err
+	}
+	keys := make([]*ecdsa.PrivateKey, len(validators))
+	for i, v := range validators {
+		key, err := x509.ParseECPrivateKey(v.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("validator %s: %v", formatAddress(v.Address), err)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
 // Blockchain persistence helpers
 func transactionsToData(txs []Transaction) []TransactionData {
 	result := make([]TransactionData, len(txs))
@@ -115,6 +272,13 @@ func transactionsToData(txs []Transaction) []TransactionData {
 			FromAddress: tx.FromAddress,
 			ToAddress:   tx.ToAddress,
 			Amount:      tx.Amount,
+			Fee:         tx.Fee,
+			Nonce:       tx.Nonce,
+			Timestamp:   tx.Timestamp,
+			Inputs:      tx.Inputs,
+			Outputs:     tx.Outputs,
+			Type:        tx.Type,
+			Payload:     tx.Payload,
 			Signature:   tx.Signature,
 		}
 	}
@@ -128,162 +292,490 @@ func dataToTransactions(data []TransactionData) []Transaction {
 			FromAddress: td.FromAddress,
 			ToAddress:   td.ToAddress,
 			Amount:      td.Amount,
+			Fee:         td.Fee,
+			Nonce:       td.Nonce,
+			Timestamp:   td.Timestamp,
+			Inputs:      td.Inputs,
+			Outputs:     td.Outputs,
+			Type:        td.Type,
+			Payload:     td.Payload,
 			Signature:   td.Signature,
 		}
 	}
 	return result
 }
 
+func blockToData(block Block) BlockData {
+	blockDataMap := make(map[string]interface{})
+	for k, v := range block.Data {
+		if k == "transactions" {
+			if txs, ok := v.([]Transaction); ok {
+				blockDataMap[k] = transactionsToData(txs)
+			} else {
+				blockDataMap[k] = v
+			}
+		} else {
+			blockDataMap[k] = v
+		}
+	}
+	return BlockData{
+		Version:    block.Version,
+		Data:       blockDataMap,
+		PrevHash:   block.PrevHash,
+		MerkleRoot: block.MerkleRoot,
+		TimeStamp:  block.TimeStamp,
+		Bits:       block.Bits,
+		Hash:       block.Hash,
+		Nonce:      block.Nonce,
+		Signer:     block.Signer,
+		Signature:  block.Signature,
+		Commit:     block.Commit,
+	}
+}
+
+func dataToBlock(bd BlockData) (Block, error) {
+	blockDataMap := make(map[string]interface{})
+	for k, v := range bd.Data {
+		if k == "transactions" {
+			txs, err := decodeTransactions(v)
+			if err != nil {
+				return Block{}, err
+			}
+			blockDataMap[k] = txs
+		} else {
+			blockDataMap[k] = v
+		}
+	}
+	return Block{
+		Version:    bd.Version,
+		Data:       blockDataMap,
+		PrevHash:   bd.PrevHash,
+		MerkleRoot: bd.MerkleRoot,
+		TimeStamp:  bd.TimeStamp,
+		Bits:       bd.Bits,
+		Hash:       bd.Hash,
+		Nonce:      bd.Nonce,
+		Signer:     bd.Signer,
+		Signature:  bd.Signature,
+		Commit:     bd.Commit,
+	}, nil
+}
+
+func chainParams(bc *Blockchain) ChainParamsData {
+	return ChainParamsData{
+		Difficulty:      bc.Difficulty,
+		MiningReward:    bc.MiningReward,
+		Model:           bc.Model,
+		MaxBlockSize:    bc.MaxBlockSize,
+		MaxBlockTxs:     bc.MaxBlockTxs,
+		RetargetMode:    bc.RetargetMode,
+		TargetBlockTime: bc.TargetBlockTime,
+		RetargetWindow:  bc.RetargetWindow,
+		HalvingInterval: bc.HalvingInterval,
+		MaxSupply:       bc.MaxSupply,
+		Consensus:       bc.Consensus,
+		Signers:         bc.Signers,
+		GenesisStakes:   bc.GenesisStakes,
+		Validators:      bc.Validators,
+	}
+}
+
+// blockchainFromParams returns an empty chain with the given settings and
+// its consensus engine attached.
+func blockchainFromParams(p ChainParamsData) (*Blockchain, error) {
+	bc := &Blockchain{
+		Chain:               []Block{},
+		Difficulty:          p.Difficulty,
+		PendingTransactions: []Transaction{},
+		MiningReward:        p.MiningReward,
+		Model:               p.Model,
+		UTXOSet:             map[string]TxOutput{},
+		MaxBlockSize:        p.MaxBlockSize,
+		MaxBlockTxs:         p.MaxBlockTxs,
+		RetargetMode:        p.RetargetMode,
+		TargetBlockTime:     p.TargetBlockTime,
+		RetargetWindow:      p.RetargetWindow,
+		HalvingInterval:     p.HalvingInterval,
+		MaxSupply:           p.MaxSupply,
+		Consensus:           p.Consensus,
+		Signers:             p.Signers,
+		GenesisStakes:       p.GenesisStakes,
+		Validators:          p.Validators,
+	}
+	engine, err := newConsensusEngine(bc.Consensus)
+	if err != nil {
+		return nil, err
+	}
+	bc.SetEngine(engine)
+	if bc.Model == "" {
+		bc.Model = ModelAccount
+	}
+	return bc, nil
+}
+
+func getChainDir() string {
+	return filepath.Join(getDataDir(), chainDir)
+}
+
 func saveBlockchain(bc *Blockchain) error {
 	if err := ensureDataDir(); err != nil {
 		return err
 	}
+	return saveChainStore(getChainDir(), bc)
+}
 
-	chainData := make([]BlockData, len(bc.Chain))
-	for i, block := range bc.Chain {
-		blockDataMap := make(map[string]interface{})
-		for k, v := range block.Data {
-			if k == "transactions" {
-				if txs, ok := v.([]Transaction); ok {
-					blockDataMap[k] = transactionsToData(txs)
-				} else {
-					blockDataMap[k] = v
-				}
-			} else {
-				blockDataMap[k] = v
-			}
+// saveChainStore writes bc to the block store in dir. Only blocks the store
+// does not already hold are written, and the pending pool is rewritten.
+func saveChainStore(dir string, bc *Blockchain) error {
+	store, err := openBlockStore(dir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := syncBlockStore(store, bc.Chain); err != nil {
+		return err
+	}
+
+	pending, err := json.MarshalIndent(transactionsToData(bc.PendingTransactions), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, pendingFile), pending, 0644); err != nil {
+		return err
+	}
+	if err := saveStateIndex(dir, bc); err != nil {
+		return err
+	}
+
+	// The meta file marks the store as complete, so it goes last.
+	metaPath := filepath.Join(dir, chainMetaFile)
+	if _, err := os.Stat(metaPath); err == nil {
+		return nil
+	}
+	meta, err := json.MarshalIndent(ChainMetaData{Version: blockchainFormatVersion, ChainParamsData: chainParams(bc)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, meta, 0644)
+}
+
+func loadBlockchain() (*Blockchain, error) {
+	if _, err := os.Stat(filepath.Join(getChainDir(), chainMetaFile)); os.IsNotExist(err) {
+		if err := migrateBlockchainFile(); err != nil {
+			return nil, err
 		}
-		chainData[i] = BlockData{
-			Data:      blockDataMap,
-			PrevHash:  block.PrevHash,
-			TimeStamp: block.TimeStamp,
-			Hash:      block.Hash,
-			Nonce:     block.Nonce,
+	}
+	return loadChainStore(getChainDir())
+}
+
+// loadChainStore reads the chain in the block store in dir. Blocks are
+// decoded one at a time as the log is read.
+func loadChainStore(dir string) (*Blockchain, error) {
+	metaPath := filepath.Join(dir, chainMetaFile)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, fileLoadError(metaPath, err)
+	}
+	var meta ChainMetaData
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fileLoadError(metaPath, err)
+	}
+	if meta.Version != blockchainFormatVersion {
+		return nil, fileLoadError(metaPath, fmt.Errorf("block store format version %d is not supported (expected %d)", meta.Version, blockchainFormatVersion))
+	}
+	bc, err := blockchainFromParams(meta.ChainParamsData)
+	if err != nil {
+		return nil, fileLoadError(metaPath, err)
+	}
+
+	store, err := openBlockStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	bc.Chain = make([]Block, 0, store.Len())
+	err = store.Each(func(_ int, block Block) error {
+		bc.Chain = append(bc.Chain, block)
+		if bc.usesUTXO() {
+			bc.applyBlockToUTXOSet(block)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(bc.Chain) == 0 {
+		return nil, fileLoadError(filepath.Join(dir, blockLogFile), fmt.Errorf("no blocks"))
 	}
 
-	bcData := BlockchainData{
-		Chain:               chainData,
-		Difficulty:          bc.Difficulty,
-		PendingTransactions: transactionsToData(bc.PendingTransactions),
-		MiningReward:        bc.MiningReward,
+	pendingPath := filepath.Join(dir, pendingFile)
+	data, err = os.ReadFile(pendingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fileLoadError(pendingPath, err)
+	}
+	if err == nil {
+		var pending []TransactionData
+		if err := decodeJSONNumbers(data, &pending); err != nil {
+			return nil, fileLoadError(pendingPath, err)
+		}
+		bc.PendingTransactions = dataToTransactions(pending)
 	}
+	loadStateIndex(dir, bc)
+	return bc, nil
+}
 
-	data, err := json.MarshalIndent(bcData, "", "  ")
+// migrateBlockchainFile moves a chain saved as a single blockchain.json into
+// the block store. The file is renamed with its format version rather than
+// deleted.
+func migrateBlockchainFile() error {
+	path := filepath.Join(getDataDir(), blockchainFile)
+	bc, fromVersion, err := readBlockchainFile(path)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(getDataDir(), blockchainFile), data, 0644)
+	if err := saveChainStore(getChainDir(), bc); err != nil {
+		return fmt.Errorf("migrating %s to the block store: %v", blockchainFile, err)
+	}
+	return os.Rename(path, fmt.Sprintf("%s.v%d.bak", path, fromVersion))
 }
 
-func loadBlockchain() (*Blockchain, error) {
-	data, err := os.ReadFile(filepath.Join(getDataDir(), blockchainFile))
+// readBlockchainFile reads a chain from a blockchain.json file, upgrading it
+// from older formats. It also returns the version the file was in.
+func readBlockchainFile(path string) (*Blockchain, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fileLoadError(path, err)
+	}
+	data, fromVersion, err := migrateBlockchainData(data)
+	if err != nil {
+		return nil, 0, fileLoadError(path, err)
+	}
+	bc, err := decodeBlockchain(data)
+	if err != nil {
+		return nil, 0, fileLoadError(path, err)
+	}
+	if fromVersion < 1 {
+		bc.convertLegacyTransactions()
+	}
+	if fromVersion < blockchainFormatVersion {
+		if err := bc.resealLegacyBlocks(); err != nil {
+			return nil, 0, fileLoadError(path, err)
+		}
+	}
+	return bc, fromVersion, nil
+}
+
+// readChainAt reads a chain from a data directory, a block store directory
+// or a blockchain.json file.
+func readChainAt(path string) (*Blockchain, error) {
+	info, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
+	if !info.IsDir() {
+		bc, _, err := readBlockchainFile(path)
+		return bc, err
+	}
+	if _, err := os.Stat(filepath.Join(path, chainMetaFile)); err == nil {
+		return loadChainStore(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, chainDir, chainMetaFile)); err == nil {
+		return loadChainStore(filepath.Join(path, chainDir))
+	}
+	return nil, fmt.Errorf("no block store found in %s", path)
+}
+
+// readGenesisSpec reads a genesis spec from a JSON file. Unknown fields are
+// rejected so a misspelled setting is not silently ignored.
+func readGenesisSpec(path string) (GenesisSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return GenesisSpec{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var spec GenesisSpec
+	if err := dec.Decode(&spec); err != nil {
+		return GenesisSpec{}, err
+	}
+	return spec, spec.Validate()
+}
 
+// decodeJSONNumbers decodes JSON keeping numbers in generic values as
+// json.Number, so amounts in block data survive the round trip exactly.
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// decodeBlockchain builds a chain from blockchain.json contents in the
+// current format.
+func decodeBlockchain(data []byte) (*Blockchain, error) {
 	var bcData BlockchainData
-	if err := json.Unmarshal(data, &bcData); err != nil {
+	if err := decodeJSONNumbers(data, &bcData); err != nil {
 		return nil, err
 	}
 
-	chain := make([]Block, len(bcData.Chain))
+	bc, err := blockchainFromParams(bcData.ChainParamsData)
+	if err != nil {
+		return nil, err
+	}
+	bc.Chain = make([]Block, len(bcData.Chain))
 	for i, bd := range bcData.Chain {
-		blockDataMap := make(map[string]interface{})
-		for k, v := range bd.Data {
-			if k == "transactions" {
-				if txDataRaw, ok := v.([]interface{}); ok {
-					txs := make([]Transaction, len(txDataRaw))
-					for j, txRaw := range txDataRaw {
-						if txMap, ok := txRaw.(map[string]interface{}); ok {
-							txs[j] = Transaction{
-								FromAddress: getJSONString(txMap, "from_address"),
-								ToAddress:   getJSONString(txMap, "to_address"),
-								Amount:      getJSONFloat(txMap, "amount"),
-								Signature:   getJSONBytes(txMap, "signature"),
-							}
-						}
-					}
-					blockDataMap[k] = txs
-				}
-			} else {
-				blockDataMap[k] = v
-			}
+		block, err := dataToBlock(bd)
+		if err != nil {
+			return nil, &LoadError{Offset: -1, Block: i, Err: err}
 		}
-		chain[i] = Block{
-			Data:      blockDataMap,
-			PrevHash:  bd.PrevHash,
-			TimeStamp: bd.TimeStamp,
-			Hash:      bd.Hash,
-			Nonce:     bd.Nonce,
+		bc.Chain[i] = block
+	}
+	bc.PendingTransactions = dataToTransactions(bcData.PendingTransactions)
+	if bcData.UTXOSet != nil {
+		bc.UTXOSet = bcData.UTXOSet
+	} else if bc.usesUTXO() {
+		if err := bc.RebuildUTXOSet(); err != nil {
+			return nil, err
 		}
 	}
+	return bc, nil
+}
 
-	return &Blockchain{
-		Chain:               chain,
-		Difficulty:          bcData.Difficulty,
-		PendingTransactions: dataToTransactions(bcData.PendingTransactions),
-		MiningReward:        bcData.MiningReward,
-	}, nil
+func blockToHeaderData(block Block) BlockHeaderData {
+	return BlockHeaderData{
+		Version:    block.Version,
+		PrevHash:   block.PrevHash,
+		MerkleRoot: block.MerkleRoot,
+		TimeStamp:  block.TimeStamp,
+		Bits:       block.Bits,
+		Nonce:      block.Nonce,
+		Hash:       block.Hash,
+		Signer:     block.Signer,
+		Signature:  block.Signature,
+	}
 }
 
-func blockchainExists() bool {
-	_, err := os.Stat(filepath.Join(getDataDir(), blockchainFile))
-	return err == nil
+func headerDataToBlock(header BlockHeaderData) Block {
+	return Block{
+		Version:    header.Version,
+		PrevHash:   header.PrevHash,
+		MerkleRoot: header.MerkleRoot,
+		TimeStamp:  header.TimeStamp,
+		Bits:       header.Bits,
+		Nonce:      header.Nonce,
+		Hash:       header.Hash,
+		Signer:     header.Signer,
+		Signature:  header.Signature,
+	}
 }
 
-func getOrCreateBlockchain() *Blockchain {
-	if blockchainExists() {
-		bc, err := loadBlockchain()
-		if err == nil {
-			return bc
+// checkProofHeader checks that a header hashes to its recorded hash and
+// carries its own proof: a hash at or below its target for a mined block, or
+// a valid seal signature for one sealed under proof of authority, proof of
+// stake or BFT. The genesis block has neither, so its header is only accepted
+// if inChain is set because it was found in the local chain.
+func checkProofHeader(header BlockHeaderData, inChain bool) error {
+	block := headerDataToBlock(header)
+	if block.calculateHash() != header.Hash {
+		return fmt.Errorf("header hash does not match header fields")
+	}
+	if header.PrevHash == zeroHash {
+		if !inChain {
+			return fmt.Errorf("the genesis header has no proof of work or seal; check it against a local chain")
 		}
+		return nil
 	}
-	bc := NewBlockchain(2, 100.0)
-	saveBlockchain(bc)
-	return bc
+	if header.Signer == "" {
+		if !hashMeetsTarget(header.Hash, header.Bits) {
+			return fmt.Errorf("header hash is above its target %s", formatBits(header.Bits))
+		}
+		return nil
+	}
+	if err := verifyHashSignature(header.Signer, header.Hash, header.Signature); err != nil {
+		return fmt.Errorf("header seal: %v", err)
+	}
+	return nil
 }
 
-// JSON helpers
-func getJSONString(m map[string]interface{}, key string) string {
-	if v, ok := m[key]; ok {
-		if s, ok := v.(string); ok {
-			return s
+// localBlockHash returns the hash of the local chain's block at height,
+// reading only the block store's index. It returns false if there is no
+// local chain.
+func localBlockHash(height int) (string, bool, error) {
+	if !blockchainExists() {
+		return "", false, nil
+	}
+	if _, err := os.Stat(filepath.Join(getChainDir(), chainMetaFile)); os.IsNotExist(err) {
+		if err := migrateBlockchainFile(); err != nil {
+			return "", true, err
 		}
 	}
-	return ""
+	store, err := openBlockStore(getChainDir())
+	if err != nil {
+		return "", true, err
+	}
+	defer store.Close()
+	hash, err := store.Hash(height)
+	return hash, true, err
 }
 
-func getJSONFloat(m map[string]interface{}, key string) float64 {
-	if v, ok := m[key]; ok {
-		if f, ok := v.(float64); ok {
-			return f
-		}
+func blockchainExists() bool {
+	if _, err := os.Stat(filepath.Join(getChainDir(), chainMetaFile)); err == nil {
+		return true
 	}
-	return 0
+	_, err := os.Stat(filepath.Join(getDataDir(), blockchainFile))
+	return err == nil
 }
 
-func getJSONBytes(m map[string]interface{}, key string) []byte {
-	if v, ok := m[key]; ok {
-		// JSON encodes []byte as base64 string
-		if s, ok := v.(string); ok {
-			decoded, err := base64.StdEncoding.DecodeString(s)
-			if err == nil {
-				return decoded
-			}
-		}
-		// Fallback for array of numbers
-		if arr, ok := v.([]interface{}); ok {
-			bytes := make([]byte, len(arr))
-			for i, b := range arr {
-				if f, ok := b.(float64); ok {
-					bytes[i] = byte(f)
-				}
-			}
-			return bytes
-		}
+// saveMinedBlock records a block mined from an in-memory copy of the chain.
+// Mining can take a while and runs without the data directory lock, so the
+// lock is taken again and the chain reloaded first: transactions sent in the
+// meantime stay pending instead of being overwritten. It returns the chain
+// as saved.
+func saveMinedBlock(block Block) (*Blockchain, error) {
+	if err := acquireDataDirLock(true); err != nil {
+		return nil, err
 	}
-	return nil
+	bc, err := loadBlockchain()
+	if err != nil {
+		return nil, err
+	}
+	if err := bc.AddBlock(block); err != nil {
+		return nil, fmt.Errorf("chain changed while mining: %v", err)
+	}
+	if err := saveBlockchain(bc); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// mustLoadBlockchain loads the chain, or explains why it cannot and exits.
+// A chain is never created here: that only happens through bloxer init, so a
+// chain that fails to load is left untouched for bloxer repair.
+func mustLoadBlockchain() *Blockchain {
+	if !blockchainExists() {
+		fmt.Printf("%s[ERROR] No blockchain found. Create one with: bloxer init%s\n", colorRed, colorReset)
+		os.Exit(1)
+	}
+	bc, err := loadBlockchain()
+	if err != nil {
+		fmt.Printf("%s[ERROR] Error loading blockchain: %v%s\n", colorRed, err, colorReset)
+		fmt.Printf("  Nothing was changed. Run %sbloxer repair%s to recover the valid blocks.\n", colorCyan, colorReset)
+		os.Exit(1)
+	}
+	return bc
+}
+
+// decodeTransactions converts the generic JSON value stored under a block's
+// "transactions" key back into transactions.
+func decodeTransactions(v interface{}) ([]Transaction, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var data []TransactionData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+	return dataToTransactions(data), nil
 }
 
 // Formatting helpers
@@ -294,12 +786,23 @@ func formatAddress(addr string) string {
 	return addr
 }
 
+// formatFee describes a transaction's fee for a one-line summary, or returns
+// nothing if it paid none.
+func formatFee(fee int64) string {
+	if fee == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (fee %s)", FormatAmount(fee))
+}
+
 func publicKeyToAddress(pubKey *ecdsa.PublicKey) string {
 	pubKeyBytes := elliptic.Marshal(elliptic.P256(), pubKey.X, pubKey.Y)
 	return fmt.Sprintf("%x", pubKeyBytes)
 }
 
 // Root command
+var lockWait bool
+
 var rootCmd = &cobra.Command{
 	Use:   "bloxer",
 	Short: "Bloxer - An educational blockchain CLI",
@@ -390,132 +893,1146 @@ var walletShowCmd = &cobra.Command{
 	},
 }
 
-// Balance command
-var balanceCmd = &cobra.Command{
-	Use:   "balance [address]",
-	Short: "Check balance of an address",
-	Long:  "Check the balance of your wallet or any address",
+// Init command
+var initModel string
+var initMaxBlockSize int
+var initMaxBlockTxs int
+var initRetarget string
+var initBlockTime int64
+var initRetargetWindow int
+var initHalvingInterval int
+var initMaxSupply string
+var initConsensus string
+var initSigners []string
+var initValidators []string
+var initStake string
+var initValidatorCount int
+var initGenesis string
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a new blockchain",
+	Long:  "Create a new blockchain. Use --model utxo for Bitcoin-style unspent outputs and --genesis to start from a shared genesis spec.",
 	Run: func(cmd *cobra.Command, args []string) {
-		bc := getOrCreateBlockchain()
-
-		var address string
-		if len(args) > 0 {
-			address = args[0]
-		} else {
-			if !walletExists() {
-				fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
-				return
-			}
-			_, address, _ = loadWallet()
+		if blockchainExists() {
+			fmt.Printf("%s%s[ERROR] Blockchain already exists!%s\n", colorRed, colorBold, colorReset)
+			fmt.Printf("  Use %sbloxer reset%s to start over\n", colorCyan, colorReset)
+			return
 		}
 
-		balance := bc.GetBalanceOfAddress(address)
-
-		fmt.Printf("\n%s%sBalance%s\n\n", colorCyan, colorBold, colorReset)
-		fmt.Printf("  %sAddress:%s %s\n", colorYellow, colorReset, formatAddress(address))
-		fmt.Printf("  %sBalance:%s %s%.2f coins%s\n\n", colorYellow, colorReset, colorGreen, balance, colorReset)
-	},
-}
-
-// Send command
-var sendAmount float64
-var sendTo string
-
-var sendCmd = &cobra.Command{
-	Use:   "send",
-	Short: "Send coins to an address",
-	Long:  "Create and sign a transaction to send coins",
-	Run: func(cmd *cobra.Command, args []string) {
-		if !walletExists() {
-			fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+		if initModel != ModelAccount && initModel != ModelUTXO {
+			fmt.Printf("%s[ERROR] Unknown model %q (expected %s or %s)%s\n", colorRed, initModel, ModelAccount, ModelUTXO, colorReset)
 			return
 		}
 
-		if sendTo == "" {
-			fmt.Printf("%s[ERROR] Please specify recipient with --to flag%s\n", colorRed, colorReset)
+		if !validRetargetMode(initRetarget) {
+			fmt.Printf("%s[ERROR] Unknown retarget mode %q (expected %s or %s)%s\n", colorRed, initRetarget, RetargetMovingAverage, RetargetEpoch, colorReset)
 			return
 		}
-
-		if sendAmount <= 0 {
-			fmt.Printf("%s[ERROR] Please specify a positive amount with --amount flag%s\n", colorRed, colorReset)
+		if initRetarget != RetargetNone && (initBlockTime <= 0 || initRetargetWindow < 2) {
+			fmt.Printf("%s[ERROR] Retargeting needs --block-time > 0 and --retarget-window >= 2%s\n", colorRed, colorReset)
 			return
 		}
 
-		privateKey, address, err := loadWallet()
+		signers, err := initialSigners(initConsensus, initSigners)
 		if err != nil {
-			fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
 			return
 		}
-
-		bc := getOrCreateBlockchain()
-
-		tx := NewTransaction(address, sendTo, sendAmount)
-		tx.signTransaction(privateKey)
-
-		if err := bc.AddTransaction(tx); err != nil {
-			fmt.Printf("%s[ERROR] Transaction failed: %v%s\n", colorRed, err, colorReset)
+		stakes, err := initialStakes(initConsensus, initValidators, initStake)
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if initConsensus != ConsensusBFT && cmd.Flags().Changed("validator-count") {
+			fmt.Printf("%s[ERROR] --validator-count only applies to --consensus %s%s\n", colorRed, ConsensusBFT, colorReset)
+			return
+		}
+		if initConsensus == ConsensusBFT && initValidatorCount < 1 {
+			fmt.Printf("%s[ERROR] --validator-count must be at least 1%s\n", colorRed, colorReset)
+			return
+		}
+		if initConsensus == ConsensusPoS && initModel != ModelAccount {
+			fmt.Printf("%s[ERROR] Proof of stake needs the %s model%s\n", colorRed, ModelAccount, colorReset)
+			return
+		}
+		if initConsensus != ConsensusPoW && initRetarget != RetargetNone {
+			fmt.Printf("%s[ERROR] --retarget only applies to proof of work%s\n", colorRed, colorReset)
 			return
 		}
 
-		if err := saveBlockchain(bc); err != nil {
-			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+		if initMaxBlockSize < 0 || initMaxBlockTxs < 0 {
+			fmt.Printf("%s[ERROR] Block limits must not be negative%s\n", colorRed, colorReset)
+			return
+		}
+		if initMaxBlockSize > 0 && initMaxBlockSize <= blockHeaderSize {
+			fmt.Printf("%s[ERROR] --max-block-size must be larger than the %d byte block header%s\n", colorRed, blockHeaderSize, colorReset)
 			return
 		}
 
-		fmt.Printf("\n%s%s[OK] Transaction created!%s\n\n", colorGreen, colorBold, colorReset)
-		fmt.Printf("  %sFrom:%s    %s\n", colorYellow, colorReset, formatAddress(address))
-		fmt.Printf("  %sTo:%s      %s\n", colorYellow, colorReset, formatAddress(sendTo))
-		fmt.Printf("  %sAmount:%s  %.2f coins\n\n", colorYellow, colorReset, sendAmount)
+		if initHalvingInterval < 0 {
+			fmt.Printf("%s[ERROR] --halving-interval must not be negative%s\n", colorRed, colorReset)
+			return
+		}
+		maxSupply, err := ParseAmount(initMaxSupply)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Invalid --max-supply: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		genesis := DefaultGenesis()
+		if initGenesis != "" {
+			genesis, err = readGenesisSpec(initGenesis)
+			if err != nil {
+				fmt.Printf("%s[ERROR] Invalid genesis spec %s: %v%s\n", colorRed, initGenesis, err, colorReset)
+				return
+			}
+		}
+		if maxSupply > 0 && genesis.Premine() > maxSupply {
+			fmt.Printf("%s[ERROR] Genesis allocations (%s coins) exceed --max-supply%s\n", colorRed, FormatAmount(genesis.Premine()), colorReset)
+			return
+		}
+
+		bc, err := NewBlockchainFromGenesis(genesis, initModel)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Invalid genesis spec: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		bc.MaxBlockSize = initMaxBlockSize
+		bc.MaxBlockTxs = initMaxBlockTxs
+		bc.HalvingInterval = initHalvingInterval
+		bc.MaxSupply = maxSupply
+		bc.Signers = signers
+		bc.GenesisStakes = stakes
+		if initConsensus == ConsensusBFT {
+			keys := make([]*ecdsa.PrivateKey, initValidatorCount)
+			for i := range keys {
+				keys[i], _, err = GenerateKeyPair()
+				if err != nil {
+					fmt.Printf("%s[ERROR] Error generating validator key: %v%s\n", colorRed, err, colorReset)
+					return
+				}
+				address, _ := addressFromKey(&keys[i].PublicKey)
+				bc.Validators = append(bc.Validators, address)
+			}
+			if err := saveValidatorKeys(keys); err != nil {
+				fmt.Printf("%s[ERROR] Error saving validator keys: %v%s\n", colorRed, err, colorReset)
+				return
+			}
+		}
+		engine, _ := newConsensusEngine(initConsensus)
+		bc.SetEngine(engine)
+		if initRetarget != RetargetNone {
+			bc.RetargetMode = initRetarget
+			bc.TargetBlockTime = initBlockTime
+			bc.RetargetWindow = initRetargetWindow
+		}
+
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Blockchain created!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sModel:%s   %s\n", colorYellow, colorReset, bc.Model)
+		fmt.Printf("  %sConsensus:%s %s\n", colorYellow, colorReset, bc.Consensus)
+		for _, signer := range bc.Signers {
+			fmt.Printf("  %sSigner:%s  %s\n", colorYellow, colorReset, formatAddress(signer))
+		}
+		for _, validator := range sortedKeys(bc.GenesisStakes) {
+			fmt.Printf("  %sValidator:%s %s (stake %s)\n", colorYellow, colorReset, formatAddress(validator), FormatAmount(bc.GenesisStakes[validator]))
+		}
+		for _, validator := range bc.Validators {
+			fmt.Printf("  %sValidator:%s %s\n", colorYellow, colorReset, formatAddress(validator))
+		}
+		if bc.MaxBlockSize > 0 {
+			fmt.Printf("  %sBlock limit:%s %d bytes\n", colorYellow, colorReset, bc.MaxBlockSize)
+		}
+		if bc.MaxBlockTxs > 0 {
+			fmt.Printf("  %sTx limit:%s %d per block\n", colorYellow, colorReset, bc.MaxBlockTxs)
+		}
+		if bc.RetargetMode != RetargetNone {
+			fmt.Printf("  %sRetarget:%s %s, %ds blocks, window %d\n", colorYellow, colorReset, bc.RetargetMode, bc.TargetBlockTime, bc.RetargetWindow)
+		}
+		if bc.HalvingInterval > 0 {
+			fmt.Printf("  %sHalving:%s every %d blocks\n", colorYellow, colorReset, bc.HalvingInterval)
+		}
+		if bc.MaxSupply > 0 {
+			fmt.Printf("  %sMax supply:%s %s coins\n", colorYellow, colorReset, FormatAmount(bc.MaxSupply))
+		}
+		if premine := bc.Premine(); premine > 0 {
+			fmt.Printf("  %sPremine:%s %s coins to %d addresses\n", colorYellow, colorReset, FormatAmount(premine), len(genesis.Allocations))
+		}
+		fmt.Printf("  %sGenesis:%s %s\n\n", colorYellow, colorReset, bc.Chain[0].Hash)
+	},
+}
+
+// initialSigners checks the --consensus and --signers flags and returns the
+// signer set to start a chain with. A proof-of-authority chain with no
+// signers given is started with the local wallet as its only signer.
+func initialSigners(consensus string, signers []string) ([]string, error) {
+	switch consensus {
+	case ConsensusPoW:
+		if len(signers) > 0 {
+			return nil, fmt.Errorf("--signers only applies to --consensus %s", ConsensusPoA)
+		}
+		return nil, nil
+	case ConsensusPoA:
+	case ConsensusPoS, ConsensusBFT:
+		if len(signers) > 0 {
+			return nil, fmt.Errorf("--signers only applies to --consensus %s", ConsensusPoA)
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown consensus %q (expected %s, %s, %s or %s)", consensus, ConsensusPoW, ConsensusPoA, ConsensusPoS, ConsensusBFT)
+	}
+	return checkAddressList("signer", signers)
+}
+
+// initialStakes checks the --validators and --stake flags and returns the
+// stake each validator starts a proof-of-stake chain with. With no
+// validators given the local wallet is the only one.
+func initialStakes(consensus string, validators []string, stake string) (map[string]int64, error) {
+	if consensus != ConsensusPoS {
+		if len(validators) > 0 {
+			return nil, fmt.Errorf("--validators only applies to --consensus %s", ConsensusPoS)
+		}
+		return nil, nil
+	}
+
+	amount, err := ParseAmount(stake)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --stake: %v", err)
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("--stake must be positive")
+	}
+	validators, err = checkAddressList("validator", validators)
+	if err != nil {
+		return nil, err
+	}
+	stakes := make(map[string]int64, len(validators))
+	for _, validator := range validators {
+		stakes[validator] = amount
+	}
+	return stakes, nil
+}
+
+// checkAddressList validates a list of addresses given on the command line,
+// defaulting to the local wallet when it is empty.
+func checkAddressList(role string, addresses []string) ([]string, error) {
+	if len(addresses) == 0 {
+		if !walletExists() {
+			return nil, fmt.Errorf("no %ss given and no wallet found; use --%ss or create a wallet first", role, role)
+		}
+		_, address, err := loadWallet()
+		if err != nil {
+			return nil, err
+		}
+		addresses = []string{address}
+	}
+	seen := make(map[string]bool)
+	for _, address := range addresses {
+		if _, err := publicKeyFromAddress(address); err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %v", role, formatAddress(address), err)
+		}
+		if seen[address] {
+			return nil, fmt.Errorf("%s %s is listed twice", role, formatAddress(address))
+		}
+		seen[address] = true
+	}
+	return addresses, nil
+}
+
+// sortedKeys returns the addresses of a stake map in order.
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Balance command
+var balanceCmd = &cobra.Command{
+	Use:   "balance [address]",
+	Short: "Check balance of an address",
+	Long:  "Check the balance of your wallet or any address",
+	Run: func(cmd *cobra.Command, args []string) {
+		// The saved state index answers this without reading any blocks
+		// when it is up to date.
+		idx, meta, ok := readTipState()
+		var bc *Blockchain
+		if !ok {
+			bc = mustLoadBlockchain()
+		}
+
+		var address string
+		if len(args) > 0 {
+			address = args[0]
+		} else {
+			if !walletExists() {
+				fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+				return
+			}
+			_, address, _ = loadWallet()
+		}
+
+		var balance, staked int64
+		showStake := false
+		if ok {
+			balance = idx.state.balances[address]
+			staked = idx.state.stakes[address]
+			showStake = meta.Consensus == ConsensusPoS
+		} else {
+			balance = bc.GetBalanceOfAddress(address)
+			if pos, isPoS := bc.Engine().(*ProofOfStake); isPoS {
+				if stakes, err := pos.Stakes(bc); err == nil {
+					staked, showStake = stakes[address], true
+				}
+			}
+		}
+
+		fmt.Printf("\n%s%sBalance%s\n\n", colorCyan, colorBold, colorReset)
+		fmt.Printf("  %sAddress:%s %s\n", colorYellow, colorReset, formatAddress(address))
+		fmt.Printf("  %sBalance:%s %s%s coins%s\n", colorYellow, colorReset, colorGreen, FormatAmount(balance), colorReset)
+		if showStake {
+			fmt.Printf("  %sStaked:%s  %s coins\n", colorYellow, colorReset, FormatAmount(staked))
+		}
+		fmt.Println()
+	},
+}
+
+// History command
+var historyLimit int
+var historySince string
+var historyCSV bool
+
+var historyCmd = &cobra.Command{
+	Use:   "history [address]",
+	Short: "List the transactions behind a balance",
+	Long: "List the confirmed rewards, incoming and outgoing transactions of your wallet or any address, oldest first, " +
+		"with the balance after each one. --since takes a block height or a date (2006-01-02 or \"2006-01-02 15:04:05\").",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var address string
+		if len(args) > 0 {
+			address = args[0]
+		} else {
+			if !walletExists() {
+				fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+				return
+			}
+			_, address, _ = loadWallet()
+		}
+		sinceHeight, sinceTime, err := parseSince(historySince)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Invalid --since: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		entries, blockAt, done, err := addressHistory(address)
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		defer done()
+
+		rows := []historyRow{}
+		var balance int64
+		for _, e := range entries {
+			balance += e.Change
+			if e.Height < sinceHeight {
+				continue
+			}
+			block, err := blockAt(e.Height)
+			if err != nil {
+				fmt.Printf("%s[ERROR] Error reading block %d: %v%s\n", colorRed, e.Height, err, colorReset)
+				return
+			}
+			if block.TimeStamp < sinceTime {
+				continue
+			}
+			rows = append(rows, newHistoryRow(e, block, address, balance))
+		}
+		matched := len(rows)
+		if historyLimit > 0 && len(rows) > historyLimit {
+			rows = rows[len(rows)-historyLimit:]
+		}
+
+		if historyCSV {
+			writeHistoryCSV(rows)
+			return
+		}
+
+		fmt.Printf("\n%s%sHistory%s\n\n", colorCyan, colorBold, colorReset)
+		fmt.Printf("  %sAddress:%s      %s\n", colorYellow, colorReset, formatAddress(address))
+		fmt.Printf("  %sTransactions:%s %d", colorYellow, colorReset, matched)
+		if len(rows) < matched {
+			fmt.Printf(" (showing the last %d)", len(rows))
+		}
+		fmt.Printf("\n\n")
+		if len(rows) == 0 {
+			fmt.Printf("  No confirmed transactions.\n\n")
+			return
+		}
+
+		fmt.Printf("  %s%-7s %-19s  %-8s %-23s %15s %15s%s\n", colorBold, "HEIGHT", "TIME", "TYPE", "COUNTERPARTY", "AMOUNT", "BALANCE", colorReset)
+		for _, r := range rows {
+			amount := fmt.Sprintf("%15s", FormatAmount(r.Change))
+			if r.Change > 0 {
+				amount = colorGreen + fmt.Sprintf("%15s", "+"+FormatAmount(r.Change)) + colorReset
+			} else if r.Change < 0 {
+				amount = colorRed + amount + colorReset
+			}
+			counterparty := r.Counterparty
+			if len(counterparty) > 23 {
+				counterparty = formatAddress(counterparty)
+			}
+			fmt.Printf("  %-7s %-19s  %-8s %-23s %s %15s\n", fmt.Sprintf("#%d", r.Height), r.Time.Format("2006-01-02 15:04:05"),
+				r.Kind, counterparty, amount, FormatAmount(r.Balance))
+		}
+		fmt.Println()
+	},
+}
+
+// addressHistory returns the address's history entries, a function reading
+// the block at a height and one to call when done with it. When the saved
+// state index is at the tip of the block store, only the history log and
+// the blocks the entries point at are read; otherwise the chain is loaded.
+func addressHistory(address string) ([]HistoryEntry, func(height int) (Block, error), func(), error) {
+	if idx, _, ok := readTipState(); ok && idx.loadHistory() == nil {
+		if store, err := openBlockStore(getChainDir()); err == nil {
+			return idx.history[address], store.Block, func() { store.Close() }, nil
+		}
+	}
+
+	bc := mustLoadBlockchain()
+	entries, err := bc.AddressHistory(address)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blockAt := func(height int) (Block, error) {
+		return bc.Chain[height], nil
+	}
+	return entries, blockAt, func() {}, nil
+}
+
+// historyRow is one line of bloxer history.
+type historyRow struct {
+	Height       int
+	Time         time.Time
+	Kind         string
+	TxID         string
+	Counterparty string
+	Change       int64
+	Fee          int64
+	Balance      int64
+}
+
+// newHistoryRow describes a history entry from address's point of view.
+func newHistoryRow(e HistoryEntry, block Block, address string, balance int64) historyRow {
+	tx := block.Transactions()[e.Tx]
+	r := historyRow{
+		Height:  e.Height,
+		Time:    time.Unix(block.TimeStamp, 0),
+		TxID:    tx.ID(),
+		Change:  e.Change,
+		Balance: balance,
+	}
+	if tx.FromAddress == address {
+		r.Fee = tx.Fee
+	}
+
+	switch {
+	case tx.FromAddress == "" && e.Height == 0:
+		r.Kind, r.Counterparty = "premine", "genesis"
+	case tx.FromAddress == "":
+		r.Kind, r.Counterparty = "reward", "coinbase"
+	case tx.Type == TxTypeStake || tx.Type == TxTypeUnstake:
+		r.Kind, r.Counterparty = tx.Type, "stake"
+	case tx.Type == TxTypeVote:
+		r.Kind, r.Counterparty = "vote", tx.ToAddress
+	case tx.Type == TxTypeEvidence && tx.FromAddress == address:
+		r.Kind, r.Counterparty = "evidence", tx.ToAddress
+	case tx.Type == TxTypeEvidence:
+		r.Kind, r.Counterparty = "slashed", tx.FromAddress
+	case tx.FromAddress == address && tx.ToAddress == address:
+		r.Kind, r.Counterparty = "self", address
+	case tx.FromAddress == address:
+		r.Kind, r.Counterparty = "out", tx.ToAddress
+	default:
+		r.Kind, r.Counterparty = "in", tx.FromAddress
+	}
+	return r
+}
+
+// writeHistoryCSV prints history rows as CSV with full addresses and exact
+// amounts, for spreadsheets.
+func writeHistoryCSV(rows []historyRow) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"height", "time", "type", "txid", "counterparty", "amount", "fee", "balance"})
+	for _, r := range rows {
+		w.Write([]string{
+			strconv.Itoa(r.Height),
+			r.Time.Format("2006-01-02 15:04:05"),
+			r.Kind,
+			r.TxID,
+			r.Counterparty,
+			canonicalAmount(r.Change),
+			canonicalAmount(r.Fee),
+			canonicalAmount(r.Balance),
+		})
+	}
+	w.Flush()
+}
+
+// parseSince reads the --since flag of bloxer history: a block height, or a
+// date or time in local time. It returns the first height and timestamp to
+// include.
+func parseSince(s string) (int, int64, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	if isDigits(s) {
+		height, err := strconv.Atoi(s)
+		return height, 0, err
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return 0, t.Unix(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%q is neither a block height nor a date like 2006-01-02", s)
+}
+
+// Send command
+var sendAmount string
+var sendFee string
+var sendTo string
+
+var sendCmd = &cobra.Command{
+	Use:   "send",
+	Short: "Send coins to an address",
+	Long:  "Create and sign a transaction to send coins",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !walletExists() {
+			fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+			return
+		}
+
+		if sendTo == "" {
+			fmt.Printf("%s[ERROR] Please specify recipient with --to flag%s\n", colorRed, colorReset)
+			return
+		}
+
+		amount, err := ParseAmount(sendAmount)
+		if err != nil || amount <= 0 {
+			fmt.Printf("%s[ERROR] Please specify a positive amount with --amount flag%s\n", colorRed, colorReset)
+			if err != nil && sendAmount != "" {
+				fmt.Printf("  %v\n", err)
+			}
+			return
+		}
+
+		fee, err := ParseAmount(sendFee)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Invalid --fee: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		privateKey, address, err := loadWallet()
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		bc := mustLoadBlockchain()
+
+		tx := NewTransaction(address, sendTo, amount)
+		tx.Fee = fee
+		if bc.usesUTXO() {
+			tx, err = bc.NewUTXOTransaction(address, sendTo, amount, fee)
+			if err != nil {
+				fmt.Printf("%s[ERROR] Transaction failed: %v%s\n", colorRed, err, colorReset)
+				return
+			}
+		}
+		tx.Nonce = bc.GetNextNonce(address)
+		tx.signTransaction(privateKey)
+
+		if err := bc.AddTransaction(tx); err != nil {
+			fmt.Printf("%s[ERROR] Transaction failed: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Transaction created!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sTx ID:%s   %s\n", colorYellow, colorReset, tx.ID())
+		fmt.Printf("  %sFrom:%s    %s\n", colorYellow, colorReset, formatAddress(address))
+		fmt.Printf("  %sTo:%s      %s\n", colorYellow, colorReset, formatAddress(sendTo))
+		fmt.Printf("  %sAmount:%s  %s coins\n", colorYellow, colorReset, FormatAmount(amount))
+		fmt.Printf("  %sFee:%s     %s coins\n", colorYellow, colorReset, FormatAmount(fee))
+		fmt.Printf("  %sNonce:%s   %d\n", colorYellow, colorReset, tx.Nonce)
+		if bc.usesUTXO() {
+			fmt.Printf("  %sInputs:%s  %d\n", colorYellow, colorReset, len(tx.Inputs))
+			if len(tx.Outputs) > 1 {
+				fmt.Printf("  %sChange:%s  %s coins\n", colorYellow, colorReset, FormatAmount(tx.Outputs[1].Amount))
+			}
+		}
+		fmt.Println()
 		fmt.Printf("  %sTransaction is pending. Run %sbloxer mine%s to include it in a block.%s\n\n", colorPurple, colorCyan, colorPurple, colorReset)
 	},
 }
 
+// Vote command
+var voteCmd = &cobra.Command{
+	Use:   "vote <add|remove> <address>",
+	Short: "Vote to add or remove a proof-of-authority signer",
+	Long:  "Create a signed vote transaction. A signer is added or removed once more than half of the current signers vote for it.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		action, candidate := args[0], args[1]
+		if action != VoteAdd && action != VoteRemove {
+			fmt.Printf("%s[ERROR] Unknown vote %q (expected %s or %s)%s\n", colorRed, action, VoteAdd, VoteRemove, colorReset)
+			return
+		}
+		if !walletExists() {
+			fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+			return
+		}
+
+		privateKey, address, err := loadWallet()
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		bc := mustLoadBlockchain()
+
+		tx := NewTransaction(address, candidate, 0)
+		tx.Type = TxTypeVote
+		tx.Payload = action
+		tx.Nonce = bc.GetNextNonce(address)
+		tx.signTransaction(privateKey)
+
+		if err := bc.AddTransaction(tx); err != nil {
+			fmt.Printf("%s[ERROR] Vote failed: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Vote created!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sTx ID:%s     %s\n", colorYellow, colorReset, tx.ID())
+		fmt.Printf("  %sVote:%s      %s %s\n", colorYellow, colorReset, action, formatAddress(candidate))
+		fmt.Printf("  %sNonce:%s     %d\n\n", colorYellow, colorReset, tx.Nonce)
+		fmt.Printf("  %sThe vote counts once it is in a block. Run %sbloxer mine%s to seal one.%s\n\n", colorPurple, colorCyan, colorPurple, colorReset)
+	},
+}
+
+// Signers command
+var signersCmd = &cobra.Command{
+	Use:   "signers",
+	Short: "List proof-of-authority signers",
+	Long:  "Show the current signer set, whose turn it is next and any open votes",
+	Run: func(cmd *cobra.Command, args []string) {
+		bc := mustLoadBlockchain()
+		poa, ok := bc.Engine().(*ProofOfAuthority)
+		if !ok {
+			fmt.Printf("%s[ERROR] This chain uses %s consensus and has no signers%s\n", colorRed, bc.Consensus, colorReset)
+			return
+		}
+		snap, err := poa.snapshotAt(bc, len(bc.Chain))
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		height := len(bc.Chain)
+		fmt.Printf("\n%s%sSigners%s (next block: #%d)\n\n", colorCyan, colorBold, colorReset, height)
+		for _, signer := range snap.sorted() {
+			marker := ""
+			if snap.inTurn(height, signer) {
+				marker = colorGreen + "  ← in turn" + colorReset
+			}
+			fmt.Printf("  %s%s\n", signer, marker)
+		}
+
+		if len(snap.votes) > 0 {
+			fmt.Printf("\n  %sOpen votes%s (%d needed to pass)\n", colorYellow, colorReset, len(snap.signers)/2+1)
+			for candidate, votes := range snap.votes {
+				tally := map[string]int{}
+				for _, vote := range votes {
+					tally[vote]++
+				}
+				fmt.Printf("  %s: %d add, %d remove\n", formatAddress(candidate), tally[VoteAdd], tally[VoteRemove])
+			}
+		}
+		fmt.Println()
+	},
+}
+
+// Stake commands
+var stakeFee string
+
+var stakeCmd = &cobra.Command{
+	Use:   "stake",
+	Short: "Manage proof-of-stake validators",
+	Long:  "Lock coins as stake, release them, list validators and report double-signing",
+}
+
+var stakeAddCmd = &cobra.Command{
+	Use:   "add <amount>",
+	Short: "Lock coins as stake",
+	Long:  "Move coins from your balance into your stake. The more you stake, the more often you are chosen to propose blocks.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		submitStakeTransaction(TxTypeStake, args[0])
+	},
+}
+
+var stakeRemoveCmd = &cobra.Command{
+	Use:   "remove <amount>",
+	Short: "Release staked coins",
+	Long:  "Move coins from your stake back to your balance once the transaction is mined",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		submitStakeTransaction(TxTypeUnstake, args[0])
+	},
+}
+
+// submitStakeTransaction signs and queues a stake or unstake transaction
+// from the local wallet.
+func submitStakeTransaction(txType, amountArg string) {
+	amount, err := ParseAmount(amountArg)
+	if err != nil || amount <= 0 {
+		fmt.Printf("%s[ERROR] Please specify a positive amount%s\n", colorRed, colorReset)
+		if err != nil {
+			fmt.Printf("  %v\n", err)
+		}
+		return
+	}
+	fee, err := ParseAmount(stakeFee)
+	if err != nil {
+		fmt.Printf("%s[ERROR] Invalid --fee: %v%s\n", colorRed, err, colorReset)
+		return
+	}
+	if !walletExists() {
+		fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+		return
+	}
+	privateKey, address, err := loadWallet()
+	if err != nil {
+		fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
+		return
+	}
+
+	bc := mustLoadBlockchain()
+
+	tx := NewTransaction(address, address, amount)
+	tx.Type = txType
+	tx.Fee = fee
+	tx.Nonce = bc.GetNextNonce(address)
+	tx.signTransaction(privateKey)
+
+	if err := bc.AddTransaction(tx); err != nil {
+		fmt.Printf("%s[ERROR] Transaction failed: %v%s\n", colorRed, err, colorReset)
+		return
+	}
+	if err := saveBlockchain(bc); err != nil {
+		fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+		return
+	}
+
+	action := "Stake"
+	if txType == TxTypeUnstake {
+		action = "Unstake"
+	}
+	fmt.Printf("\n%s%s[OK] %s transaction created!%s\n\n", colorGreen, colorBold, action, colorReset)
+	fmt.Printf("  %sTx ID:%s   %s\n", colorYellow, colorReset, tx.ID())
+	fmt.Printf("  %sAmount:%s  %s coins\n", colorYellow, colorReset, FormatAmount(amount))
+	fmt.Printf("  %sFee:%s     %s coins\n", colorYellow, colorReset, FormatAmount(fee))
+	fmt.Printf("  %sNonce:%s   %d\n\n", colorYellow, colorReset, tx.Nonce)
+	fmt.Printf("  %sThe stake changes once it is in a block. Run %sbloxer mine%s to include it.%s\n\n", colorPurple, colorCyan, colorPurple, colorReset)
+}
+
+var stakeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List validators and their stake",
+	Long:  "Show every validator's stake, its share of the total and who proposes the next block",
+	Run: func(cmd *cobra.Command, args []string) {
+		bc := mustLoadBlockchain()
+		pos, ok := bc.Engine().(*ProofOfStake)
+		if !ok {
+			fmt.Printf("%s[ERROR] This chain uses %s consensus and has no validators%s\n", colorRed, bc.Consensus, colorReset)
+			return
+		}
+		stakes, err := pos.Stakes(bc)
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		height := len(bc.Chain)
+		proposer, _ := selectProposer(stakes, bc.GetLatestBlock().Hash, height, 0)
+		var total int64
+		for _, stake := range stakes {
+			total += stake
+		}
+
+		fmt.Printf("\n%s%sValidators%s (next block: #%d)\n\n", colorCyan, colorBold, colorReset, height)
+		for _, validator := range sortedKeys(stakes) {
+			marker := ""
+			if validator == proposer {
+				marker = colorGreen + "  ← proposes round 0" + colorReset
+			}
+			fmt.Printf("  %s  %s coins (%.1f%%)%s\n", formatAddress(validator), FormatAmount(stakes[validator]),
+				100*float64(stakes[validator])/float64(total), marker)
+		}
+		fmt.Printf("\n  %sTotal stake:%s %s coins\n\n", colorYellow, colorReset, FormatAmount(total))
+	},
+}
+
+var stakeEvidenceCmd = &cobra.Command{
+	Use:   "evidence <header1.json> <header2.json>",
+	Short: "Report a validator for double-signing",
+	Long: "Submit two block headers signed by the same validator on the same parent as evidence. " +
+		"Once mined, the validator's whole stake is slashed. Each file may hold a header or a proof from bloxer tx proof.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var headers [2]BlockHeaderData
+		for i, path := range args {
+			header, err := readHeaderFile(path)
+			if err != nil {
+				fmt.Printf("%s[ERROR] %s: %v%s\n", colorRed, path, err, colorReset)
+				return
+			}
+			headers[i] = header
+		}
+		ev := DoubleSignEvidence{First: headers[0], Second: headers[1]}
+		offender, err := ev.verify()
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error encoding evidence: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fee, err := ParseAmount(stakeFee)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Invalid --fee: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if !walletExists() {
+			fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
+			return
+		}
+		privateKey, address, err := loadWallet()
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		bc := mustLoadBlockchain()
+
+		tx := NewTransaction(address, offender, 0)
+		tx.Type = TxTypeEvidence
+		tx.Payload = string(payload)
+		tx.Fee = fee
+		tx.Nonce = bc.GetNextNonce(address)
+		tx.signTransaction(privateKey)
+
+		if err := bc.AddTransaction(tx); err != nil {
+			fmt.Printf("%s[ERROR] Evidence rejected: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Evidence submitted!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sTx ID:%s     %s\n", colorYellow, colorReset, tx.ID())
+		fmt.Printf("  %sOffender:%s  %s\n", colorYellow, colorReset, formatAddress(offender))
+		fmt.Printf("  %sBlocks:%s    %s, %s\n\n", colorYellow, colorReset, formatAddress(ev.First.Hash), formatAddress(ev.Second.Hash))
+		fmt.Printf("  %sThe stake is slashed once the evidence is in a block. Run %sbloxer mine%s to include it.%s\n\n", colorPurple, colorCyan, colorPurple, colorReset)
+	},
+}
+
+// readHeaderFile reads a block header saved as JSON, either on its own or as
+// part of a Merkle proof.
+func readHeaderFile(path string) (BlockHeaderData, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return BlockHeaderData{}, err
+	}
+	var proof MerkleProofData
+	if err := json.Unmarshal(data, &proof); err == nil && proof.Header.Hash != "" {
+		return proof.Header, nil
+	}
+	var header BlockHeaderData
+	if err := json.Unmarshal(data, &header); err != nil {
+		return BlockHeaderData{}, err
+	}
+	if header.Hash == "" {
+		return BlockHeaderData{}, fmt.Errorf("no block header found")
+	}
+	return header, nil
+}
+
 // Mine command
+var mineThreads int
+var mineContinuous bool
+var mineBlocks int
+var mineUntilHeight int
+var mineOffline int
+
 var mineCmd = &cobra.Command{
 	Use:   "mine",
 	Short: "Mine pending transactions",
-	Long:  "Mine a new block with pending transactions and receive a reward",
+	Long:  "Mine a new block with pending transactions and receive a reward. Use --continuous to keep mining until interrupted.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if !walletExists() {
 			fmt.Printf("%s[ERROR] No wallet found. Create one with: bloxer wallet create%s\n", colorRed, colorReset)
 			return
 		}
 
-		_, address, err := loadWallet()
+		key, address, err := loadWallet()
 		if err != nil {
 			fmt.Printf("%s[ERROR] Error loading wallet: %v%s\n", colorRed, err, colorReset)
 			return
 		}
 
-		bc := getOrCreateBlockchain()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if mineContinuous || mineBlocks > 0 || mineUntilHeight > 0 {
+			mineContinuously(ctx, key, address)
+			return
+		}
+
+		bc := mustLoadBlockchain()
 
 		fmt.Printf("\n%s%sMining block...%s\n\n", colorYellow, colorBold, colorReset)
-		fmt.Printf("  Difficulty: %d\n", bc.Difficulty)
-		fmt.Printf("  Pending transactions: %d\n\n", len(bc.PendingTransactions))
+		configureEngine(bc, nil, key)
+		printSealTarget(bc)
+		pending := len(bc.PendingTransactions)
+		fmt.Printf("  Pending transactions: %d\n\n", pending)
+
+		miner := NewMiner(mineThreads)
+		var hashRate float64
+		miner.OnProgress = func(s MinerStats) {
+			hashRate = s.HashRate
+			fmt.Printf("\r  %sHash rate:%s %s (%d hashes)   ", colorYellow, colorReset, formatHashRate(s.HashRate), s.Hashes)
+			if s.Done {
+				fmt.Println()
+			}
+		}
 
 		startTime := time.Now()
-		bc.MinePendingTransactions(address)
+		configureEngine(bc, miner, key)
+		releaseDataDirLock()
+		block, err := bc.MinePendingTransactions(ctx, address)
 		duration := time.Since(startTime)
+		if err != nil {
+			fmt.Printf("\n%s[ERROR] Mining stopped: %v. Nothing was saved.%s\n", colorRed, err, colorReset)
+			return
+		}
 
-		if err := saveBlockchain(bc); err != nil {
+		bc, err = saveMinedBlock(block)
+		if err != nil {
 			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
 			return
 		}
 
-		fmt.Printf("\n%s%s[OK] Block mined successfully!%s\n\n", colorGreen, colorBold, colorReset)
+		// Only proof-of-work blocks are mined; the other engines sign them.
+		verb := "mined"
+		if _, ok := bc.Engine().(*ProofOfWork); !ok {
+			verb = "sealed"
+		}
+		fmt.Printf("\n%s%s[OK] Block %s successfully!%s\n\n", colorGreen, colorBold, verb, colorReset)
+		fmt.Printf("  %sBlock:%s #%d %s\n", colorYellow, colorReset, len(bc.Chain)-1, block.Hash)
 		fmt.Printf("  %sTime taken:%s %v\n", colorYellow, colorReset, duration.Round(time.Millisecond))
-		fmt.Printf("  %sReward:%s %.2f coins\n", colorYellow, colorReset, bc.MiningReward)
-		fmt.Printf("  %sNew balance:%s %.2f coins\n\n", colorYellow, colorReset, bc.GetBalanceOfAddress(address))
+		if hashRate > 0 {
+			fmt.Printf("  %sHash rate:%s %s\n", colorYellow, colorReset, formatHashRate(hashRate))
+		}
+		fmt.Printf("  %sBlock size:%s %d bytes\n", colorYellow, colorReset, block.Size())
+		if block.Commit != nil {
+			fmt.Printf("  %sCommitted:%s round %d, %d of %d precommits (final)\n", colorYellow, colorReset, block.Commit.Round, len(block.Commit.Precommits), len(bc.Validators))
+		}
+		fmt.Printf("  %sTransactions:%s included %d, deferred %d\n", colorYellow, colorReset, includedTransactions(block), pending-includedTransactions(block))
+		fmt.Printf("  %sReward:%s %s coins + %s in fees\n", colorYellow, colorReset, FormatAmount(bc.BlockSubsidy(len(bc.Chain)-1)), FormatAmount(block.Fees()))
+		fmt.Printf("  %sNew balance:%s %s coins\n\n", colorYellow, colorReset, FormatAmount(bc.GetBalanceOfAddress(address)))
 	},
 }
 
+// configureEngine hands the local miner settings and wallet key to the
+// chain's consensus engine: proof of work uses the miner, proof of authority
+// and proof of stake sign with the key, and BFT runs the validators whose
+// keys were created with the chain.
+func configureEngine(bc *Blockchain, miner *Miner, key *ecdsa.PrivateKey) {
+	switch engine := bc.Engine().(type) {
+	case *ProofOfWork:
+		engine.Miner = miner
+	case *ProofOfAuthority:
+		engine.Key = key
+	case *ProofOfStake:
+		engine.Key = key
+	case *BFT:
+		if keys, err := loadValidatorKeys(); err == nil {
+			engine.Keys = keys
+		}
+		// Crash the first --offline validators in address order.
+		sorted := append([]string(nil), bc.Validators...)
+		sort.Strings(sorted)
+		engine.Offline = make(map[string]bool)
+		for i := 0; i < mineOffline && i < len(sorted); i++ {
+			engine.Offline[sorted[i]] = true
+		}
+	}
+}
+
+// printSealTarget describes what sealing the next block involves.
+func printSealTarget(bc *Blockchain) {
+	bits := bc.NextBits()
+	switch engine := bc.Engine().(type) {
+	case *ProofOfAuthority:
+		turn := "out of turn"
+		if bits == diffInTurn {
+			turn = "in turn"
+		}
+		fmt.Printf("  Sealing as signer: %s (difficulty %d)\n", turn, bits)
+		if signers, err := engine.CurrentSigners(bc); err == nil {
+			fmt.Printf("  Signers: %d\n", len(signers))
+		}
+	case *ProofOfStake:
+		me, err := addressFromKey(&engine.Key.PublicKey)
+		if err != nil {
+			return
+		}
+		round, opens, err := engine.NextRound(bc, me)
+		if err != nil {
+			fmt.Printf("  %v\n", err)
+			return
+		}
+		if wait := time.Until(time.Unix(opens, 0)); wait > 0 {
+			fmt.Printf("  Proposing in round %d, opens in %v\n", round, wait.Round(time.Second))
+		} else {
+			fmt.Printf("  Proposing in round %d (open now)\n", round)
+		}
+	case *BFT:
+		fmt.Printf("  Validators: %d of %d online\n", len(bc.Validators)-len(engine.Offline), len(bc.Validators))
+		fmt.Printf("  Round 0 proposer: %s\n", formatAddress(bftProposer(bc.Validators, len(bc.Chain), 0)))
+	default:
+		fmt.Printf("  Target bits: %s (difficulty %.2f)\n", formatBits(bits), bitsDifficulty(bits))
+		fmt.Printf("  Threads: %d\n", mineThreads)
+	}
+}
+
+// mineContinuously mines block after block until ctx is cancelled or the
+// --blocks / --until-height target is reached. Each block is saved as soon as
+// it is found, on top of a freshly loaded chain, so transactions sent in the
+// meantime are picked up for the next block and an interrupt never loses a
+// mined block.
+func mineContinuously(ctx context.Context, key *ecdsa.PrivateKey, address string) {
+	var (
+		found       int
+		hashes      uint64
+		elapsed     time.Duration
+		earned      int64
+		blockHashes uint64
+	)
+	miner := NewMiner(mineThreads)
+	miner.OnProgress = func(s MinerStats) {
+		if s.Done {
+			blockHashes = s.Hashes
+			fmt.Print("\r\033[K")
+			return
+		}
+		fmt.Printf("\r  %sHash rate:%s %s (%d hashes)", colorYellow, colorReset, formatHashRate(s.HashRate), s.Hashes)
+	}
+
+	fmt.Printf("\n%s%sMining continuously...%s (Ctrl+C to stop)\n", colorYellow, colorBold, colorReset)
+	fmt.Printf("  Threads: %d\n", mineThreads)
+	if mineBlocks > 0 {
+		fmt.Printf("  Stopping after %d blocks\n", mineBlocks)
+	}
+	if mineUntilHeight > 0 {
+		fmt.Printf("  Stopping at height %d\n", mineUntilHeight)
+	}
+	fmt.Println()
+
+	bc := mustLoadBlockchain()
+	for ctx.Err() == nil {
+		if mineBlocks > 0 && found >= mineBlocks {
+			break
+		}
+		if mineUntilHeight > 0 && len(bc.Chain)-1 >= mineUntilHeight {
+			break
+		}
+
+		pending := len(bc.PendingTransactions)
+		startTime := time.Now()
+		configureEngine(bc, miner, key)
+		releaseDataDirLock()
+		block, err := bc.MinePendingTransactions(ctx, address)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("\n%s[ERROR] Mining stopped: %v%s\n", colorRed, err, colorReset)
+			}
+			break
+		}
+		duration := time.Since(startTime)
+
+		saved, err := saveMinedBlock(block)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			break
+		}
+		bc = saved
+
+		found++
+		elapsed += duration
+		hashes += blockHashes
+		if txs := block.Transactions(); len(txs) > 0 && isCoinbase(txs[0]) && txs[0].ToAddress == address {
+			earned += bc.coinbaseValue(txs[0])
+		}
+		fmt.Printf("  %s#%d%s %s  %d/%d txs  |  found %d  avg %v  %s  earned %s coins\n",
+			colorGreen, len(bc.Chain)-1, colorReset, formatAddress(block.Hash),
+			includedTransactions(block), pending, found,
+			(elapsed / time.Duration(found)).Round(time.Millisecond),
+			formatHashRate(float64(hashes)/elapsed.Seconds()), FormatAmount(earned))
+	}
+
+	fmt.Printf("\n%s%s[OK] Mining stopped%s\n\n", colorGreen, colorBold, colorReset)
+	fmt.Printf("  %sBlocks found:%s %d\n", colorYellow, colorReset, found)
+	if found > 0 {
+		fmt.Printf("  %sAverage time:%s %v\n", colorYellow, colorReset, (elapsed / time.Duration(found)).Round(time.Millisecond))
+		fmt.Printf("  %sHash rate:%s %s\n", colorYellow, colorReset, formatHashRate(float64(hashes)/elapsed.Seconds()))
+	}
+	fmt.Printf("  %sEarned:%s %s coins\n", colorYellow, colorReset, FormatAmount(earned))
+	fmt.Printf("  %sHeight:%s %d\n\n", colorYellow, colorReset, len(bc.Chain)-1)
+}
+
 // Chain command
 var chainCmd = &cobra.Command{
 	Use:   "chain",
 	Short: "View the blockchain",
 	Long:  "Display all blocks in the blockchain",
 	Run: func(cmd *cobra.Command, args []string) {
-		bc := getOrCreateBlockchain()
+		bc := mustLoadBlockchain()
 
 		fmt.Printf("\n%s%sBlockchain%s\n", colorCyan, colorBold, colorReset)
 		fmt.Printf("  Total blocks: %d\n\n", len(bc.Chain))
@@ -525,16 +2042,46 @@ var chainCmd = &cobra.Command{
 			fmt.Printf("  │ %sHash:%s      %s\n", colorYellow, colorReset, formatAddress(block.Hash))
 			fmt.Printf("  │ %sPrev:%s      %s\n", colorYellow, colorReset, formatAddress(block.PrevHash))
 			fmt.Printf("  │ %sTimestamp:%s %s\n", colorYellow, colorReset, time.Unix(block.TimeStamp, 0).Format("2006-01-02 15:04:05"))
-			fmt.Printf("  │ %sNonce:%s     %d\n", colorYellow, colorReset, block.Nonce)
+			fmt.Printf("  │ %sMerkle:%s    %s\n", colorYellow, colorReset, formatAddress(block.MerkleRoot))
+			if i > 0 && (bc.Consensus == ConsensusPoS || bc.Consensus == ConsensusBFT) {
+				fmt.Printf("  │ %sProposer:%s  %s\n", colorYellow, colorReset, formatAddress(block.Signer))
+				fmt.Printf("  │ %sRound:%s     %d\n", colorYellow, colorReset, block.Nonce)
+				if block.Commit != nil {
+					fmt.Printf("  │ %sCommit:%s    %d of %d precommits (final)\n", colorYellow, colorReset, len(block.Commit.Precommits), len(bc.Validators))
+				}
+			} else if i > 0 && block.Signer != "" {
+				fmt.Printf("  │ %sSigner:%s    %s\n", colorYellow, colorReset, formatAddress(block.Signer))
+				fmt.Printf("  │ %sDifficulty:%s %d\n", colorYellow, colorReset, block.Bits)
+				fmt.Printf("  │ %sChainwork:%s %s\n", colorYellow, colorReset, bc.ChainWork(i))
+			} else if i > 0 {
+				fmt.Printf("  │ %sBits:%s      %s (difficulty %.2f)\n", colorYellow, colorReset, formatBits(block.Bits), bitsDifficulty(block.Bits))
+				fmt.Printf("  │ %sChainwork:%s %s\n", colorYellow, colorReset, bc.ChainWork(i))
+			}
+			if bc.Consensus != ConsensusPoS && bc.Consensus != ConsensusBFT {
+				fmt.Printf("  │ %sNonce:%s     %d\n", colorYellow, colorReset, block.Nonce)
+			}
 
 			if txs, ok := block.Data["transactions"].([]Transaction); ok && len(txs) > 0 {
 				fmt.Printf("  │ %sTransactions:%s\n", colorYellow, colorReset)
 				for _, tx := range txs {
 					from := formatAddress(tx.FromAddress)
-					if tx.FromAddress == "" {
+					if i == 0 {
+						from = colorGreen + "PREMINE" + colorReset
+					} else if tx.FromAddress == "" {
 						from = colorGreen + "MINING REWARD" + colorReset
 					}
-					fmt.Printf("  │   %s → %s: %.2f\n", from, formatAddress(tx.ToAddress), tx.Amount)
+					switch tx.Type {
+					case TxTypeVote:
+						fmt.Printf("  │   [%s] %s votes to %s %s%s\n", tx.ID()[:8], from, tx.Payload, formatAddress(tx.ToAddress), formatFee(tx.Fee))
+						continue
+					case TxTypeStake, TxTypeUnstake:
+						fmt.Printf("  │   [%s] %s %ss %s%s\n", tx.ID()[:8], from, tx.Type, FormatAmount(tx.Amount), formatFee(tx.Fee))
+						continue
+					case TxTypeEvidence:
+						fmt.Printf("  │   [%s] %s reports %s for double-signing%s\n", tx.ID()[:8], from, formatAddress(tx.ToAddress), formatFee(tx.Fee))
+						continue
+					}
+					fmt.Printf("  │   [%s] %s → %s: %s%s\n", tx.ID()[:8], from, formatAddress(tx.ToAddress), FormatAmount(tx.Amount), formatFee(tx.Fee))
 				}
 			}
 			fmt.Printf("  %s└────────────────────────────────────────────────┘%s\n\n", colorBlue, colorReset)
@@ -552,19 +2099,217 @@ var validateCmd = &cobra.Command{
 	Short: "Validate the blockchain",
 	Long:  "Check if the blockchain is valid and hasn't been tampered with",
 	Run: func(cmd *cobra.Command, args []string) {
-		bc := getOrCreateBlockchain()
+		bc := mustLoadBlockchain()
 
 		fmt.Printf("\n%s%sValidating blockchain...%s\n\n", colorCyan, colorBold, colorReset)
 
-		if bc.IsChainValid() {
+		if err := bc.ValidateChain(); err == nil {
 			fmt.Printf("  %s%s[OK] Blockchain is valid!%s\n\n", colorGreen, colorBold, colorReset)
 		} else {
 			fmt.Printf("  %s%s[ERROR] Blockchain is INVALID!%s\n\n", colorRed, colorBold, colorReset)
+			fmt.Printf("  Reason: %v\n", err)
 			fmt.Printf("  The chain may have been tampered with.\n\n")
 		}
 	},
 }
 
+// Transaction commands
+var txCmd = &cobra.Command{
+	Use:   "tx",
+	Short: "Inspect transactions",
+	Long:  "Look up transactions and prove their inclusion in a block",
+}
+
+var txShowCmd = &cobra.Command{
+	Use:   "show <txid>",
+	Short: "Show a transaction",
+	Long:  "Show a transaction by ID (or unique ID prefix), the block containing it and its confirmations, or whether it is still pending",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bc := mustLoadBlockchain()
+
+		tx, height, _, err := bc.FindTransaction(args[0])
+		pending := false
+		if err != nil {
+			var pendingErr error
+			tx, pendingErr = bc.FindPendingTransaction(args[0])
+			if pendingErr != nil {
+				fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+				return
+			}
+			pending = true
+		}
+
+		fmt.Printf("\n%s%sTransaction%s\n\n", colorCyan, colorBold, colorReset)
+		fmt.Printf("  %sID:%s            %s\n", colorYellow, colorReset, tx.ID())
+		if pending {
+			fmt.Printf("  %sStatus:%s        %spending%s\n", colorYellow, colorReset, colorPurple, colorReset)
+		} else {
+			block := bc.Chain[height]
+			fmt.Printf("  %sStatus:%s        %sconfirmed%s\n", colorYellow, colorReset, colorGreen, colorReset)
+			fmt.Printf("  %sBlock:%s         #%d %s\n", colorYellow, colorReset, height, formatAddress(block.Hash))
+			fmt.Printf("  %sConfirmations:%s %d\n", colorYellow, colorReset, len(bc.Chain)-height)
+		}
+		fmt.Printf("  %sCreated:%s       %s\n", colorYellow, colorReset, time.Unix(tx.Timestamp, 0).Format("2006-01-02 15:04:05"))
+
+		from := formatAddress(tx.FromAddress)
+		if tx.FromAddress == "" {
+			from = colorGreen + "MINING REWARD" + colorReset
+		}
+		fmt.Printf("  %sFrom:%s          %s\n", colorYellow, colorReset, from)
+		fmt.Printf("  %sTo:%s            %s\n", colorYellow, colorReset, formatAddress(tx.ToAddress))
+		fmt.Printf("  %sAmount:%s        %s coins\n", colorYellow, colorReset, FormatAmount(tx.Amount))
+		if tx.FromAddress != "" {
+			fmt.Printf("  %sFee:%s           %s coins\n", colorYellow, colorReset, FormatAmount(tx.Fee))
+		}
+		fmt.Printf("  %sNonce:%s         %d\n", colorYellow, colorReset, tx.Nonce)
+
+		for _, in := range tx.Inputs {
+			if in.TxID == "" {
+				fmt.Printf("  %sInput:%s         coinbase (height %d)\n", colorYellow, colorReset, in.Index)
+				continue
+			}
+			fmt.Printf("  %sInput:%s         %s\n", colorYellow, colorReset, formatAddress(outpoint(in.TxID, in.Index)))
+		}
+		for i, out := range tx.Outputs {
+			fmt.Printf("  %sOutput %d:%s      %s: %s\n", colorYellow, i, colorReset, formatAddress(out.Address), FormatAmount(out.Amount))
+		}
+		fmt.Println()
+	},
+}
+
+var txProofOut string
+
+var txProofCmd = &cobra.Command{
+	Use:   "proof <txid>",
+	Short: "Create a Merkle inclusion proof for a transaction",
+	Long:  "Create a proof that a confirmed transaction is included in a block. The proof can be checked against the block header alone.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		bc := mustLoadBlockchain()
+
+		tx, height, index, err := bc.FindTransaction(args[0])
+		if err != nil {
+			fmt.Printf("%s[ERROR] %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		block := bc.Chain[height]
+		path, err := merkleProof(block.Version, block.merkleLeaves(), index)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error building proof: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		proof := MerkleProofData{
+			TxID:   tx.ID(),
+			Height: height,
+			Header: blockToHeaderData(block),
+			Path:   path,
+		}
+		data, err := json.MarshalIndent(proof, "", "  ")
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error encoding proof: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		if txProofOut == "" {
+			fmt.Println(string(data))
+			return
+		}
+		if err := os.WriteFile(txProofOut, data, 0644); err != nil {
+			fmt.Printf("%s[ERROR] Error writing proof: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Proof written!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sTransaction:%s %s\n", colorYellow, colorReset, formatAddress(proof.TxID))
+		fmt.Printf("  %sBlock:%s       #%d\n", colorYellow, colorReset, height)
+		fmt.Printf("  %sPath length:%s %d\n", colorYellow, colorReset, len(path))
+		fmt.Printf("  %sFile:%s        %s\n\n", colorYellow, colorReset, txProofOut)
+	},
+}
+
+var txVerifyProofCmd = &cobra.Command{
+	Use:   "verify-proof <file>",
+	Short: "Verify a Merkle inclusion proof",
+	Long: "Check that a proof links a transaction to the Merkle root of a block header, that the header hash is correct " +
+		"and meets its proof-of-work target or carries a valid seal, and, if there is a local chain, that the header is its block at the proof's height",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error reading proof: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		var proof MerkleProofData
+		if err := json.Unmarshal(data, &proof); err != nil {
+			fmt.Printf("%s[ERROR] Error parsing proof: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%sVerifying proof...%s\n\n", colorCyan, colorBold, colorReset)
+		fmt.Printf("  %sTransaction:%s %s\n", colorYellow, colorReset, formatAddress(proof.TxID))
+		fmt.Printf("  %sBlock:%s       #%d %s\n\n", colorYellow, colorReset, proof.Height, formatAddress(proof.Header.Hash))
+
+		local, ok, err := localBlockHash(proof.Height)
+		if err != nil {
+			fmt.Printf("  %s%s[ERROR] Cannot check the header against the local chain: %v%s\n\n", colorRed, colorBold, err, colorReset)
+			return
+		}
+		if ok && local != proof.Header.Hash {
+			fmt.Printf("  %s%s[ERROR] Header is not block #%d of the local chain%s\n\n", colorRed, colorBold, proof.Height, colorReset)
+			return
+		}
+		if err := checkProofHeader(proof.Header, ok); err != nil {
+			fmt.Printf("  %s%s[ERROR] Invalid header: %v%s\n\n", colorRed, colorBold, err, colorReset)
+			return
+		}
+
+		if !verifyMerkleProof(proof.Header.Version, proof.TxID, proof.Path, proof.Header.MerkleRoot) {
+			fmt.Printf("  %s%s[ERROR] Proof does not lead to the block's Merkle root%s\n\n", colorRed, colorBold, colorReset)
+			return
+		}
+
+		fmt.Printf("  %s%s[OK] Transaction is included in the block!%s\n\n", colorGreen, colorBold, colorReset)
+	},
+}
+
+// Import command
+var importCmd = &cobra.Command{
+	Use:   "import <path>",
+	Short: "Switch to a competing copy of the chain",
+	Long: "Load another chain with the same genesis block and switch to it if it is valid and has more work. " +
+		"The path can be another data directory, its chain directory, or a blockchain.json file. " +
+		"Blocks that are final under BFT consensus are never replaced.",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		other, err := readChainAt(args[0])
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error reading chain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		bc := mustLoadBlockchain()
+		oldHeight := len(bc.Chain) - 1
+		dropped, err := bc.ReplaceChain(other)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Chain not imported: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Switched to the imported chain!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sHeight:%s      %d → %d\n", colorYellow, colorReset, oldHeight, len(bc.Chain)-1)
+		fmt.Printf("  %sReorganized:%s %d blocks\n", colorYellow, colorReset, dropped)
+		fmt.Printf("  %sPending:%s     %d transactions\n\n", colorYellow, colorReset, len(bc.PendingTransactions))
+	},
+}
+
 // Reset command
 var resetAll bool
 
@@ -574,9 +2319,11 @@ var resetCmd = &cobra.Command{
 	Long:  "Delete blockchain data and start fresh. Use --all to also delete wallet.",
 	Run: func(cmd *cobra.Command, args []string) {
 		dataPath := getDataDir()
-		bcPath := filepath.Join(dataPath, blockchainFile)
-
-		if err := os.Remove(bcPath); err != nil && !os.IsNotExist(err) {
+		if err := os.RemoveAll(getChainDir()); err != nil {
+			fmt.Printf("%s[ERROR] Error resetting blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if err := os.Remove(filepath.Join(dataPath, blockchainFile)); err != nil && !os.IsNotExist(err) {
 			fmt.Printf("%s[ERROR] Error resetting blockchain: %v%s\n", colorRed, err, colorReset)
 			return
 		}
@@ -592,7 +2339,88 @@ var resetCmd = &cobra.Command{
 			fmt.Printf("%s%s[OK] Wallet deleted!%s\n\n", colorGreen, colorBold, colorReset)
 		}
 
-		fmt.Printf("  A new genesis block will be created on next operation.\n\n")
+		fmt.Printf("  Run %sbloxer init%s to create a new chain.\n\n", colorCyan, colorReset)
+	},
+}
+
+// Reindex command
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the balance index from the chain",
+	Long:  "Discard the saved account state index and rebuild it by replaying every block.",
+	Run: func(cmd *cobra.Command, args []string) {
+		bc := mustLoadBlockchain()
+		start := time.Now()
+		if err := bc.RebuildStateIndex(); err != nil {
+			fmt.Printf("%s[ERROR] Chain cannot be indexed: %v%s\n", colorRed, err, colorReset)
+			fmt.Printf("  Run %sbloxer validate%s for details or %sbloxer repair%s to recover the valid blocks.\n", colorCyan, colorReset, colorCyan, colorReset)
+			return
+		}
+		if err := saveBlockchain(bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving state index: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] State index rebuilt!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sHeight:%s   %d\n", colorYellow, colorReset, bc.index.Height)
+		fmt.Printf("  %sAccounts:%s %d\n", colorYellow, colorReset, len(bc.index.state.balances))
+		if bc.usesUTXO() {
+			fmt.Printf("  %sOutputs:%s  %d unspent\n", colorYellow, colorReset, len(bc.index.state.utxos))
+		}
+		fmt.Printf("  %sTime:%s     %v\n\n", colorYellow, colorReset, time.Since(start).Round(time.Millisecond))
+	},
+}
+
+// Repair command
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Recover a blockchain that fails to load",
+	Long: "Move an unreadable or invalid chain aside and rebuild it from the longest run of valid blocks at its start. " +
+		"Pending transactions that still apply are kept.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !blockchainExists() {
+			fmt.Printf("%s[ERROR] No blockchain found. Create one with: bloxer init%s\n", colorRed, colorReset)
+			return
+		}
+		dir := getChainDir()
+		if _, err := os.Stat(filepath.Join(dir, chainMetaFile)); os.IsNotExist(err) {
+			// Only a blockchain.json from an older version; loading migrates it.
+			if _, err := loadBlockchain(); err != nil {
+				fmt.Printf("%s[ERROR] Error migrating %s: %v%s\n", colorRed, blockchainFile, err, colorReset)
+				fmt.Printf("  Repair works on the block store only. Fix the file at the position shown, or move it aside and run %sbloxer init%s.\n", colorCyan, colorReset)
+				return
+			}
+		}
+
+		if bc, err := loadChainStore(dir); err == nil && bc.ValidateChain() == nil {
+			fmt.Printf("\n%s%s[OK] Blockchain loads and is valid. Nothing to repair.%s\n\n", colorGreen, colorBold, colorReset)
+			return
+		}
+
+		bc, report, err := recoverChainStore(dir)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Cannot repair blockchain: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		quarantined, err := quarantineChainStore(dir)
+		if err != nil {
+			fmt.Printf("%s[ERROR] Error moving the damaged chain aside: %v%s\n", colorRed, err, colorReset)
+			return
+		}
+		if err := saveChainStore(dir, bc); err != nil {
+			fmt.Printf("%s[ERROR] Error saving repaired blockchain: %v%s\n", colorRed, err, colorReset)
+			fmt.Printf("  The damaged chain is in %s\n", quarantined)
+			return
+		}
+
+		fmt.Printf("\n%s%s[OK] Blockchain repaired!%s\n\n", colorGreen, colorBold, colorReset)
+		fmt.Printf("  %sBlocks read:%s      %d\n", colorYellow, colorReset, report.Read)
+		fmt.Printf("  %sBlocks kept:%s      %d (height %d)\n", colorYellow, colorReset, report.Recovered, report.Recovered-1)
+		if report.Problem != nil {
+			fmt.Printf("  %sStopped at:%s       %v\n", colorYellow, colorReset, report.Problem)
+		}
+		fmt.Printf("  %sPending:%s          %d kept, %d dropped\n", colorYellow, colorReset, report.PendingKept, report.PendingDropped)
+		fmt.Printf("  %sDamaged chain:%s    %s\n\n", colorYellow, colorReset, quarantined)
 	},
 }
 
@@ -623,25 +2451,93 @@ func initCLI() {
 	walletCmd.AddCommand(walletShowCmd)
 	walletCmd.AddCommand(walletDeleteCmd)
 
+	// Init flags
+	initCmd.Flags().StringVarP(&initModel, "model", "m", ModelAccount, "Transaction model: account or utxo")
+	initCmd.Flags().StringVar(&initGenesis, "genesis", "", "Genesis spec file with timestamp, message, difficulty, reward and premine allocations")
+	initCmd.Flags().StringVar(&initRetarget, "retarget", RetargetNone, "Difficulty retargeting: moving-average or epoch (default fixed difficulty)")
+	initCmd.Flags().Int64Var(&initBlockTime, "block-time", 10, "Target seconds between blocks when retargeting")
+	initCmd.Flags().IntVar(&initRetargetWindow, "retarget-window", 10, "Number of blocks the retargeting looks back over")
+	initCmd.Flags().IntVar(&initMaxBlockSize, "max-block-size", 0, "Maximum serialized block size in bytes, packed by fee rate (0 = unlimited)")
+	initCmd.Flags().IntVar(&initMaxBlockTxs, "max-block-txs", 0, "Maximum transactions per block, including the reward (0 = unlimited)")
+	initCmd.Flags().IntVar(&initHalvingInterval, "halving-interval", 0, "Halve the block subsidy every N blocks (0 = never)")
+	initCmd.Flags().StringVar(&initConsensus, "consensus", ConsensusPoW, "Consensus engine: pow, poa, pos or bft")
+	initCmd.Flags().StringSliceVar(&initSigners, "signers", nil, "Initial proof-of-authority signer addresses (default: your wallet)")
+	initCmd.Flags().StringSliceVar(&initValidators, "validators", nil, "Initial proof-of-stake validator addresses (default: your wallet)")
+	initCmd.Flags().StringVar(&initStake, "stake", "100", "Stake each initial validator starts with")
+	initCmd.Flags().IntVar(&initValidatorCount, "validator-count", 4, "Number of BFT validators to create for the simulated network")
+	initCmd.Flags().StringVar(&initMaxSupply, "max-supply", "0", "Stop issuing new coins once this many exist (0 = unlimited)")
+
 	// Send flags
-	sendCmd.Flags().Float64VarP(&sendAmount, "amount", "a", 0, "Amount to send")
+	sendCmd.Flags().StringVarP(&sendAmount, "amount", "a", "", fmt.Sprintf("Amount to send (up to %d decimal places)", CoinDecimals))
 	sendCmd.Flags().StringVarP(&sendTo, "to", "t", "", "Recipient address")
+	sendCmd.Flags().StringVarP(&sendFee, "fee", "f", "0", "Fee paid to the miner who includes the transaction")
+
+	// History flags
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 0, "Show only the most recent entries (0 = all)")
+	historyCmd.Flags().StringVar(&historySince, "since", "", "Start at this block height or date")
+	historyCmd.Flags().BoolVar(&historyCSV, "csv", false, "Print CSV with full addresses and exact amounts")
+
+	// Transaction subcommands
+	txProofCmd.Flags().StringVarP(&txProofOut, "out", "o", "", "Write the proof to a file instead of stdout")
+	txCmd.AddCommand(txShowCmd)
+	txCmd.AddCommand(txProofCmd)
+	txCmd.AddCommand(txVerifyProofCmd)
+
+	// Stake subcommands
+	stakeCmd.PersistentFlags().StringVarP(&stakeFee, "fee", "f", "0", "Fee paid to the proposer who includes the transaction")
+	stakeCmd.AddCommand(stakeAddCmd)
+	stakeCmd.AddCommand(stakeRemoveCmd)
+	stakeCmd.AddCommand(stakeListCmd)
+	stakeCmd.AddCommand(stakeEvidenceCmd)
+
+	// Mine flags
+	mineCmd.Flags().IntVar(&mineThreads, "threads", runtime.NumCPU(), "Number of mining threads")
+	mineCmd.Flags().BoolVarP(&mineContinuous, "continuous", "c", false, "Keep mining blocks until interrupted")
+	mineCmd.Flags().IntVar(&mineBlocks, "blocks", 0, "Stop after mining this many blocks (implies --continuous)")
+	mineCmd.Flags().IntVar(&mineUntilHeight, "until-height", 0, "Stop once the chain reaches this height (implies --continuous)")
+	mineCmd.Flags().IntVar(&mineOffline, "offline", 0, "Simulate this many BFT validators as crashed")
 
 	// Reset flags
 	resetCmd.Flags().BoolVarP(&resetAll, "all", "a", false, "Also delete wallet")
 
 	// Add all commands to root
+	rootCmd.PersistentPreRun = lockDataDir
+	rootCmd.PersistentPostRun = func(cmd *cobra.Command, args []string) { releaseDataDirLock() }
+	rootCmd.PersistentFlags().BoolVar(&lockWait, "wait", false, "Wait for other bloxer commands using the data directory instead of failing")
+
 	rootCmd.AddCommand(walletCmd)
+	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(balanceCmd)
 	rootCmd.AddCommand(sendCmd)
 	rootCmd.AddCommand(mineCmd)
+	rootCmd.AddCommand(voteCmd)
+	rootCmd.AddCommand(signersCmd)
+	rootCmd.AddCommand(stakeCmd)
 	rootCmd.AddCommand(chainCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(txCmd)
 	rootCmd.AddCommand(resetCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(reindexCmd)
+	rootCmd.AddCommand(historyCmd)
 
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 }
 
+// lockDataDir runs before every command and holds the data directory lock
+// until the command exits.
+func lockDataDir(cmd *cobra.Command, args []string) {
+	if cmd.Name() == "help" {
+		return
+	}
+	if err := acquireDataDirLock(lockWait); err != nil {
+		fmt.Printf("%s[ERROR] Data directory is locked: %v%s\n", colorRed, err, colorReset)
+		fmt.Printf("  Wait for it to finish, or rerun with %s--wait%s\n", colorCyan, colorReset)
+		os.Exit(1)
+	}
+}
+
 func runCLI() {
 	initCLI()
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+)
+
+// Consensus engine names, as stored in blockchain.json.
+const (
+	ConsensusPoW = "pow"
+	ConsensusPoA = "poa"
+	ConsensusPoS = "pos"
+	ConsensusBFT = "bft"
+)
+
+// ConsensusEngine decides what makes a block acceptable and how a new block
+// earns that status. The blockchain hands every block it mines to Seal and
+// every block it validates to VerifySeal, so swapping the engine changes the
+// consensus rules without touching the rest of the chain logic.
+type ConsensusEngine interface {
+	// Name identifies the engine in the saved chain.
+	Name() string
+
+	// Difficulty returns the Bits value the block at height must carry,
+	// based only on the blocks before it.
+	Difficulty(bc *Blockchain, height int) uint32
+
+	// Seal completes a block whose contents and Bits are final, for example
+	// by searching for a proof-of-work nonce, and sets its Hash. It returns
+	// ctx.Err() if cancelled before the block is sealed.
+	Seal(ctx context.Context, bc *Blockchain, block *Block) error
+
+	// VerifySeal checks that the block at height was sealed according to the
+	// engine's rules.
+	VerifySeal(bc *Blockchain, height int) error
+
+	// BlockWork returns how much a block with the given Bits adds to the
+	// chain's total work, which decides between competing chains.
+	BlockWork(bits uint32) *big.Int
+}
+
+// newConsensusEngine returns a fresh engine for a saved consensus name.
+// Chains saved before engines existed have no name and use proof of work.
+func newConsensusEngine(name string) (ConsensusEngine, error) {
+	switch name {
+	case "", ConsensusPoW:
+		return &ProofOfWork{}, nil
+	case ConsensusPoA:
+		return &ProofOfAuthority{}, nil
+	case ConsensusPoS:
+		return &ProofOfStake{}, nil
+	case ConsensusBFT:
+		return &BFT{}, nil
+	}
+	return nil, fmt.Errorf("unknown consensus engine %q", name)
+}
+
+// Engine returns the chain's consensus engine, defaulting to proof of work.
+func (bc *Blockchain) Engine() ConsensusEngine {
+	if bc.engine == nil {
+		engine, err := newConsensusEngine(bc.Consensus)
+		if err != nil {
+			engine = &ProofOfWork{}
+		}
+		bc.engine = engine
+	}
+	return bc.engine
+}
+
+// SetEngine switches the chain to the given consensus engine.
+func (bc *Blockchain) SetEngine(engine ConsensusEngine) {
+	bc.engine = engine
+	bc.Consensus = engine.Name()
+}
+
+// checkTransactionType rejects typed transactions the chain's consensus
+// engine has no use for.
+func (bc *Blockchain) checkTransactionType(tx Transaction) error {
+	switch tx.Type {
+	case "":
+		return nil
+	case TxTypeVote:
+		if _, ok := bc.Engine().(*ProofOfAuthority); !ok {
+			return fmt.Errorf("vote transactions need proof-of-authority consensus")
+		}
+		return nil
+	case TxTypeStake, TxTypeUnstake, TxTypeEvidence:
+		if _, ok := bc.Engine().(*ProofOfStake); !ok {
+			return fmt.Errorf("%s transactions need proof-of-stake consensus", tx.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transaction type %q", tx.Type)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const lockFile = "lock"
+
+// errLocked is returned by tryLockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// dataDirLock is the open lock file while this process holds the data
+// directory lock.
+var dataDirLock *os.File
+
+// acquireDataDirLock takes the advisory lock on the data directory, so two
+// bloxer commands never read and write the chain at the same time. If the
+// lock is held elsewhere it fails, or with wait set, blocks until it is
+// released. Acquiring a lock already held by this process does nothing.
+func acquireDataDirLock(wait bool) error {
+	if dataDirLock != nil {
+		return nil
+	}
+	if err := ensureDataDir(); err != nil {
+		return err
+	}
+	path := filepath.Join(getDataDir(), lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = tryLockFile(f)
+	if errors.Is(err, errLocked) {
+		holder := lockHolder(f)
+		if !wait {
+			f.Close()
+			return fmt.Errorf("another bloxer command%s is using %s", holder, getDataDir())
+		}
+		fmt.Printf("%sWaiting for another bloxer command%s to finish...%s\n", colorYellow, holder, colorReset)
+		err = lockFileWait(f)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Record who holds the lock for the error message above.
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	dataDirLock = f
+	return nil
+}
+
+// releaseDataDirLock lets other commands use the data directory. The lock
+// is also released when the process exits.
+func releaseDataDirLock() {
+	if dataDirLock == nil {
+		return
+	}
+	dataDirLock.Truncate(0)
+	unlockFile(dataDirLock)
+	dataDirLock.Close()
+	dataDirLock = nil
+}
+
+// lockHolder describes the process recorded in the lock file, if any.
+func lockHolder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid := strings.TrimSpace(string(buf[:n]))
+	if pid == "" {
+		return ""
+	}
+	return " (pid " + pid + ")"
+}
+
+// writeFileAtomic replaces the file at path with data so that a crash leaves
+// either the old contents or the new, never a mix: the data goes to a
+// temporary file in the same directory, is flushed to disk and then renamed
+// over the original.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory so a rename in it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
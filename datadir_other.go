@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Advisory file locks are only implemented on Unix. Elsewhere commands do
+// not wait for each other, as before the lock was added.
+
+func tryLockFile(f *os.File) error {
+	return nil
+}
+
+func lockFileWait(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
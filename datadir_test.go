@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlappingMinesSecondSaveFails(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(releaseDataDirLock)
+	if err := saveBlockchain(NewBlockchain(1, 50*UnitsPerCoin)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two mine commands load the same chain and mine without the lock.
+	var blocks []Block
+	for _, miner := range []string{"alice", "bob"} {
+		bc, err := loadBlockchain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := bc.MinePendingTransactions(context.Background(), miner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	if _, err := saveMinedBlock(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	releaseDataDirLock()
+	_, err := saveMinedBlock(blocks[1])
+	releaseDataDirLock()
+	checkErr(t, err, "chain changed while mining")
+
+	bc, err := loadBlockchain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bc.Chain) != 2 || bc.GetLatestBlock().Hash != blocks[0].Hash {
+		t.Fatalf("chain has %d blocks ending in %s, want 2 ending in the first mined block %s", len(bc.Chain), bc.GetLatestBlock().Hash, blocks[0].Hash)
+	}
+	if alice, bob := bc.GetBalanceOfAddress("alice"), bc.GetBalanceOfAddress("bob"); alice != 50*UnitsPerCoin || bob != 0 {
+		t.Fatalf("balances after both saves: alice %d, bob %d", alice, bob)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallet.json")
+	for _, data := range []string{"first", "second, longer", "third"} {
+		if err := writeFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Fatalf("file holds %q, want %q", got, data)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode is %v, want 0600", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the written one", len(entries))
+	}
+}
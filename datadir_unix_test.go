@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDataDirLockHeldElsewhere(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(releaseDataDirLock)
+	if err := ensureDataDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another command holds the lock through its own open file.
+	other, err := os.OpenFile(filepath.Join(getDataDir(), lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := tryLockFile(other); err != nil {
+		t.Fatal(err)
+	}
+	other.WriteString("12345\n")
+
+	checkErr(t, acquireDataDirLock(false), "another bloxer command (pid 12345) is using")
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- acquireDataDirLock(true)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("lock taken while held elsewhere: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := unlockFile(other); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting command did not get the lock once it was released")
+	}
+}
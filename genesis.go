@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultGenesisTimestamp is the timestamp of the built-in genesis block,
+// 2025-01-01 00:00:00 UTC. A fixed time keeps every default chain's genesis
+// hash the same.
+const defaultGenesisTimestamp = 1735689600
+
+// GenesisSpec describes a chain's genesis block and starting parameters. Two
+// chains created from the same spec, with the same transaction model, have
+// the same genesis hash.
+type GenesisSpec struct {
+	Timestamp   int64               `json:"timestamp"`
+	Message     string              `json:"message"`
+	Difficulty  int                 `json:"difficulty"`
+	Reward      genesisAmount       `json:"reward"`
+	Allocations []GenesisAllocation `json:"allocations,omitempty"`
+}
+
+// GenesisAllocation premines coins to an address in the genesis block.
+type GenesisAllocation struct {
+	Address string        `json:"address"`
+	Amount  genesisAmount `json:"amount"`
+}
+
+// genesisAmount is a coin amount written in a genesis spec either as a JSON
+// number or as a string, e.g. 12.5 or "12.5".
+type genesisAmount int64
+
+func (a *genesisAmount) UnmarshalJSON(data []byte) error {
+	units, err := ParseAmount(strings.Trim(string(data), `"`))
+	if err != nil {
+		return err
+	}
+	*a = genesisAmount(units)
+	return nil
+}
+
+// DefaultGenesis returns the spec used when none is given.
+func DefaultGenesis() GenesisSpec {
+	return GenesisSpec{
+		Timestamp:  defaultGenesisTimestamp,
+		Message:    "Genesis Block",
+		Difficulty: 2,
+		Reward:     genesisAmount(100 * UnitsPerCoin),
+	}
+}
+
+// Validate checks that the spec describes a usable chain.
+func (g GenesisSpec) Validate() error {
+	if g.Timestamp <= 0 {
+		return fmt.Errorf("timestamp must be positive")
+	}
+	if g.Timestamp > time.Now().Unix()+maxFutureDrift {
+		return fmt.Errorf("timestamp %s is in the future", formatTimestamp(g.Timestamp))
+	}
+	if g.Difficulty < 1 || g.Difficulty > 32 {
+		return fmt.Errorf("difficulty must be between 1 and 32")
+	}
+	if g.Reward < 0 {
+		return fmt.Errorf("reward must not be negative")
+	}
+	for i, alloc := range g.Allocations {
+		if _, err := publicKeyFromAddress(alloc.Address); err != nil {
+			return fmt.Errorf("allocation %d: invalid address: %v", i, err)
+		}
+		if alloc.Amount <= 0 {
+			return fmt.Errorf("allocation %d: amount must be positive", i)
+		}
+	}
+	return nil
+}
+
+// Premine returns the total amount allocated in the genesis block.
+func (g GenesisSpec) Premine() int64 {
+	var total int64
+	for _, alloc := range g.Allocations {
+		total += int64(alloc.Amount)
+	}
+	return total
+}
+
+// Block builds the genesis block. The allocations are paid like mining
+// rewards: account chains get one transaction per allocation, UTXO chains a
+// single coinbase with one output per allocation. The message, reward and
+// difficulty are stored in the block's data, which its Merkle root commits
+// to, so every field of the spec changes the genesis hash. The difficulty
+// is also the block's Bits.
+func (g GenesisSpec) Block(model string) Block {
+	data := map[string]interface{}{
+		"message":    g.Message,
+		"reward":     int64(g.Reward),
+		"difficulty": g.Difficulty,
+	}
+	if len(g.Allocations) > 0 {
+		var txs []Transaction
+		if model == ModelUTXO {
+			tx := NewTransaction("", "", g.Premine())
+			tx.Timestamp = g.Timestamp
+			tx.Inputs = []TxInput{{TxID: "", Index: 0}}
+			for _, alloc := range g.Allocations {
+				tx.Outputs = append(tx.Outputs, TxOutput{Address: alloc.Address, Amount: int64(alloc.Amount)})
+			}
+			txs = append(txs, tx)
+		} else {
+			for i, alloc := range g.Allocations {
+				tx := NewTransaction("", alloc.Address, int64(alloc.Amount))
+				tx.Timestamp = g.Timestamp
+				tx.Nonce = uint64(i)
+				txs = append(txs, tx)
+			}
+		}
+		data["transactions"] = txs
+	}
+
+	block := NewBlock(g.Timestamp, data)
+	block.Bits = difficultyToBits(g.Difficulty)
+	block.PrevHash = zeroHash
+	block.Hash = block.calculateHash()
+	return block
+}
+
+// NewBlockchainFromGenesis creates a chain of the given transaction model
+// starting from the spec's genesis block.
+func NewBlockchainFromGenesis(g GenesisSpec, model string) (*Blockchain, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	bc := NewBlockchain(g.Difficulty, int64(g.Reward))
+	bc.Model = model
+	bc.Chain = []Block{g.Block(model)}
+	if bc.usesUTXO() {
+		if err := bc.RebuildUTXOSet(); err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// Premine returns the coins allocated in the chain's genesis block.
+func (bc *Blockchain) Premine() int64 {
+	var total int64
+	for _, tx := range bc.Chain[0].Transactions() {
+		total += bc.coinbaseValue(tx)
+	}
+	return total
+}
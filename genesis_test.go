@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testGenesisSpec() GenesisSpec {
+	return GenesisSpec{
+		Timestamp:  1760000000,
+		Message:    "Bloxer testnet",
+		Difficulty: 2,
+		Reward:     genesisAmount(50 * UnitsPerCoin),
+		Allocations: []GenesisAllocation{
+			{Address: "alice", Amount: genesisAmount(1000 * UnitsPerCoin)},
+			{Address: "bob", Amount: genesisAmount(250 * UnitsPerCoin)},
+		},
+	}
+}
+
+func TestGenesisHashCommitsToSpec(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(g *GenesisSpec)
+	}{
+		{name: "timestamp", change: func(g *GenesisSpec) { g.Timestamp++ }},
+		{name: "message", change: func(g *GenesisSpec) { g.Message = "Another testnet" }},
+		{name: "difficulty", change: func(g *GenesisSpec) { g.Difficulty = 3 }},
+		{name: "reward", change: func(g *GenesisSpec) { g.Reward = genesisAmount(25 * UnitsPerCoin) }},
+		{name: "allocation address", change: func(g *GenesisSpec) { g.Allocations[1].Address = "carol" }},
+		{name: "allocation amount", change: func(g *GenesisSpec) { g.Allocations[0].Amount++ }},
+		{name: "extra allocation", change: func(g *GenesisSpec) {
+			g.Allocations = append(g.Allocations, GenesisAllocation{Address: "carol", Amount: 1})
+		}},
+		{name: "no allocations", change: func(g *GenesisSpec) { g.Allocations = nil }},
+	}
+
+	for _, model := range []string{ModelAccount, ModelUTXO} {
+		base := testGenesisSpec().Block(model)
+		if again := testGenesisSpec().Block(model); again.Hash != base.Hash {
+			t.Fatalf("%s: the same spec gave hashes %s and %s", model, base.Hash, again.Hash)
+		}
+		for _, tt := range tests {
+			t.Run(model+"/"+tt.name, func(t *testing.T) {
+				g := testGenesisSpec()
+				tt.change(&g)
+				if got := g.Block(model).Hash; got == base.Hash {
+					t.Fatalf("changing the %s left the genesis hash at %s", tt.name, got)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateChainChecksGenesis(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(b *Block)
+		wantErr string
+	}{
+		{name: "untouched"},
+		{
+			name:    "allocation amount",
+			tamper:  func(b *Block) { b.Transactions()[0].Amount = 1_000_000 * UnitsPerCoin },
+			wantErr: "block 0: merkle root",
+		},
+		{
+			name:    "message",
+			tamper:  func(b *Block) { b.Data["message"] = "edited" },
+			wantErr: "block 0: merkle root",
+		},
+		{
+			name:    "previous hash",
+			tamper:  func(b *Block) { b.PrevHash = strings.Repeat("1", 64) },
+			wantErr: "block 0: genesis previous hash",
+		},
+		{
+			name:    "timestamp",
+			tamper:  func(b *Block) { b.TimeStamp++ },
+			wantErr: "block 0: hash does not match",
+		},
+		{
+			name: "allocation with a sender",
+			tamper: func(b *Block) {
+				b.Transactions()[0].FromAddress = "alice"
+				b.MerkleRoot = b.calculateMerkleRoot()
+				b.Hash = b.calculateHash()
+			},
+			wantErr: "premine payouts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The test addresses are not real keys, which
+			// NewBlockchainFromGenesis would reject.
+			bc := NewBlockchain(2, 50*UnitsPerCoin)
+			bc.Chain[0] = testGenesisSpec().Block(ModelAccount)
+			if tt.tamper != nil {
+				tt.tamper(&bc.Chain[0])
+			}
+			checkErr(t, bc.ValidateChain(), tt.wantErr)
+		})
+	}
+}
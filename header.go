@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// BlockHeaderVersion is the header encoding written by this build. Versions
+// 3 and 4 changed only how the Merkle root is computed, see
+// taggedMerkleVersion and dataLeafVersion; version 5 added the signer.
+const BlockHeaderVersion = 5
+
+// minBlockHeaderVersion is the oldest header version blocks are accepted in.
+const minBlockHeaderVersion = 2
+
+// signerHeaderVersion is the first header version that commits to who
+// sealed the block. Before it, the signer and signature sat outside the
+// hash, so another authorized signer could re-seal a block without changing
+// its hash or the next block's previous hash.
+const signerHeaderVersion = 5
+
+// blockHeaderSize is the length of an encoded header:
+//
+//	offset  size  field
+//	0       4     version     uint32, big-endian
+//	4       32    prev hash   raw SHA-256 bytes
+//	36      32    merkle root raw SHA-256 bytes
+//	68      8     timestamp   int64 Unix seconds, big-endian
+//	76      4     bits        uint32 compact target, big-endian
+//	80      8     nonce       uint64, big-endian
+//	88      65    signer      uncompressed public key, zero if unsealed
+//
+// Headers before signerHeaderVersion end after the nonce, at
+// baseHeaderSize bytes.
+const (
+	blockHeaderSize = baseHeaderSize + signerSize
+	baseHeaderSize  = 88
+	signerSize      = 65
+)
+
+// zeroHash is the previous hash recorded in the genesis block.
+var zeroHash = hex.EncodeToString(make([]byte, 32))
+
+// encodeHeader returns the canonical byte encoding of the block header. The
+// block hash is the SHA-256 of these bytes, so it only depends on header
+// values and not on how the block was stored or printed.
+func (b *Block) encodeHeader() ([]byte, error) {
+	prev, err := decodeHash32(b.PrevHash)
+	if err != nil {
+		return nil, fmt.Errorf("prev hash: %v", err)
+	}
+	root, err := decodeHash32(b.MerkleRoot)
+	if err != nil {
+		return nil, fmt.Errorf("merkle root: %v", err)
+	}
+
+	buf := make([]byte, b.headerSize())
+	binary.BigEndian.PutUint32(buf[0:4], b.Version)
+	copy(buf[4:36], prev)
+	copy(buf[36:68], root)
+	binary.BigEndian.PutUint64(buf[68:76], uint64(b.TimeStamp))
+	binary.BigEndian.PutUint32(buf[76:80], b.Bits)
+	binary.BigEndian.PutUint64(buf[80:88], uint64(b.Nonce))
+	if b.Version >= signerHeaderVersion && b.Signer != "" {
+		signer, err := hex.DecodeString(b.Signer)
+		if err != nil {
+			return nil, fmt.Errorf("signer: %v", err)
+		}
+		if len(signer) != signerSize {
+			return nil, fmt.Errorf("signer: expected %d bytes, got %d", signerSize, len(signer))
+		}
+		copy(buf[88:], signer)
+	}
+	return buf, nil
+}
+
+// headerSize returns the length of the block's encoded header.
+func (b *Block) headerSize() int {
+	if b.Version < signerHeaderVersion {
+		return baseHeaderSize
+	}
+	return blockHeaderSize
+}
+
+func decodeHash32(s string) ([]byte, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("expected 32 bytes, got %d", len(raw))
+	}
+	return raw, nil
+}
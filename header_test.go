@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockHashSurvivesSaveAndLoad(t *testing.T) {
+	key, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := addressFromKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2^53 + 1 units has no exact float64 form, so it only survives a
+	// save and load if amounts are never decoded as floats.
+	spec := DefaultGenesis()
+	spec.Difficulty = 1
+	spec.Allocations = []GenesisAllocation{{Address: alice, Amount: 1<<53 + 1}}
+	bc, err := NewBlockchainFromGenesis(spec, ModelAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := NewTransaction(alice, "bob", 3*UnitsPerCoin+1)
+	tx.Fee = 12345
+	tx.Nonce = bc.GetNextNonce(alice)
+	tx.signTransaction(key)
+	if err := bc.AddTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.MinePendingTransactions(context.Background(), "miner"); err != nil {
+		t.Fatal(err)
+	}
+	mineTransfer(t, bc, "miner", "carol", UnitsPerCoin)
+
+	dir := t.TempDir()
+	if err := saveChainStore(dir, bc); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadChainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Chain) != len(bc.Chain) {
+		t.Fatalf("loaded %d blocks, saved %d", len(loaded.Chain), len(bc.Chain))
+	}
+	for i := range bc.Chain {
+		saved, got := &bc.Chain[i], &loaded.Chain[i]
+		want, err := saved.encodeHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := got.encodeHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(header, want) {
+			t.Errorf("block %d: header after loading is\n %x\nwant\n %x", i, header, want)
+		}
+		if got.Hash != saved.Hash {
+			t.Errorf("block %d: stored hash after loading is %s, want %s", i, got.Hash, saved.Hash)
+		}
+		if hash := got.calculateHash(); hash != saved.Hash {
+			t.Errorf("block %d: hash recomputed after loading is %s, want %s", i, hash, saved.Hash)
+		}
+		if root := got.calculateMerkleRoot(); root != saved.MerkleRoot {
+			t.Errorf("block %d: Merkle root recomputed after loading is %s, want %s", i, root, saved.MerkleRoot)
+		}
+	}
+
+	// Saving the loaded chain again writes the same bytes.
+	again := t.TempDir()
+	if err := saveChainStore(again, loaded); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{blockLogFile, blockIndexFile} {
+		first, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := os.ReadFile(filepath.Join(again, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Errorf("%s differs after a load and save", name)
+		}
+	}
+}
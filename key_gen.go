@@ -2,13 +2,17 @@ package main
 
 //using elliptic curve cryptography for key generation
 import (
+	"crypto"
+	"crypto/ecdh"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"math/big"
 )
 
 func calculateSHA256(data string) string {
@@ -41,3 +45,60 @@ func EncodePublicKeyToPEM(publicKey *ecdsa.PublicKey) ([]byte, error) {
 	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509Encoded})
 	return pemEncoded, nil
 }
+
+// addressFromKey returns the address for a public key: its uncompressed
+// point encoding in hex.
+func addressFromKey(publicKey *ecdsa.PublicKey) (string, error) {
+	ecdhKey, err := publicKey.ECDH()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(ecdhKey.Bytes()), nil
+}
+
+// publicKeyFromAddress is the inverse of addressFromKey.
+func publicKeyFromAddress(address string) (*ecdsa.PublicKey, error) {
+	publicKeyBytes, err := hex.DecodeString(address)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding public key: %v", err)
+	}
+
+	ecdhPubKey, err := ecdh.P256().NewPublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+
+	// Extract X and Y coordinates from the ECDH public key bytes
+	// Format: [0x04 || X (32 bytes) || Y (32 bytes)] for uncompressed P256
+	keyBytes := ecdhPubKey.Bytes()
+	x := new(big.Int).SetBytes(keyBytes[1:33])
+	y := new(big.Int).SetBytes(keyBytes[33:65])
+
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// signHash signs a hex-encoded SHA-256 hash.
+func signHash(privateKey *ecdsa.PrivateKey, hash string) ([]byte, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding hash: %v", err)
+	}
+	return privateKey.Sign(rand.Reader, hashBytes, crypto.SHA256)
+}
+
+// verifyHashSignature checks that sig is a signature of the hex-encoded hash
+// by the key behind address.
+func verifyHashSignature(address, hash string, sig []byte) error {
+	publicKey, err := publicKeyFromAddress(address)
+	if err != nil {
+		return err
+	}
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return fmt.Errorf("error decoding hash: %v", err)
+	}
+	if !ecdsa.VerifyASN1(publicKey, hashBytes, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
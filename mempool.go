@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// selectTransactions picks the pending transactions for the next block. With
+// no block limits every pending transaction is taken in order. Otherwise the
+// highest fee-per-byte transactions are packed first, while each sender's
+// transactions still go in nonce order, until the block reaches MaxBlockSize
+// bytes or MaxBlockTxs transactions. reservedBytes and reservedTxs are kept
+// free for the block header and mining reward. Transactions that are not
+// picked stay pending for a later block.
+func (bc *Blockchain) selectTransactions(reservedBytes, reservedTxs int) []Transaction {
+	pending := bc.PendingTransactions
+	if bc.MaxBlockSize <= 0 && bc.MaxBlockTxs <= 0 {
+		return pending
+	}
+
+	// Position of each transaction within its sender's queue. A transaction
+	// is only eligible once everything before it from the same sender is in.
+	queuePos := make([]int, len(pending))
+	queued := make(map[string]int)
+	for i, tx := range pending {
+		queuePos[i] = queued[tx.FromAddress]
+		queued[tx.FromAddress]++
+	}
+
+	order := make([]int, len(pending))
+	sizes := make([]int, len(pending))
+	for i := range pending {
+		order[i] = i
+		sizes[i] = pending[i].Size()
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		// Compare fee/size ratios without dividing.
+		return pending[i].Fee*int64(sizes[j]) > pending[j].Fee*int64(sizes[i])
+	})
+
+	selected := make([]bool, len(pending))
+	blocked := make(map[string]bool)
+	included := make(map[string]int)
+	var picked []Transaction
+	size := reservedBytes
+
+	for progress := true; progress; {
+		progress = false
+		if bc.MaxBlockTxs > 0 && reservedTxs+len(picked) >= bc.MaxBlockTxs {
+			break
+		}
+		for _, i := range order {
+			tx := pending[i]
+			if selected[i] || blocked[tx.FromAddress] {
+				continue
+			}
+			if queuePos[i] != included[tx.FromAddress] {
+				continue
+			}
+			if bc.MaxBlockSize > 0 && size+sizes[i] > bc.MaxBlockSize {
+				// Later nonces from this sender cannot go in without this one.
+				blocked[tx.FromAddress] = true
+				continue
+			}
+			selected[i] = true
+			picked = append(picked, tx)
+			size += sizes[i]
+			included[tx.FromAddress]++
+			progress = true
+			break
+		}
+	}
+
+	return picked
+}
+
+// dropInapplicable removes picked transactions that no longer apply on top
+// of the chain in the order they were picked. Packing by fee rate can move a
+// staking transaction ahead of one it conflicts with, such as evidence that
+// slashes a validator before that validator's own unstake. Dropped
+// transactions, and any later ones from the same sender, stay pending.
+func (bc *Blockchain) dropInapplicable(picked []Transaction) []Transaction {
+	typed := false
+	for _, tx := range picked {
+		typed = typed || tx.Type != ""
+	}
+	if !typed {
+		return picked
+	}
+	state, err := bc.tipState()
+	if err != nil {
+		return picked
+	}
+	kept := picked[:0:0]
+	for _, tx := range picked {
+		if state.applyTransaction(tx) == nil {
+			kept = append(kept, tx)
+		}
+	}
+	return kept
+}
+
+// includedTransactions counts the transactions a block took from the pending
+// pool, leaving out its mining reward.
+func includedTransactions(b Block) int {
+	n := 0
+	for _, tx := range b.Transactions() {
+		if !isCoinbase(tx) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkBlockLimits rejects blocks larger than MaxBlockSize bytes or holding
+// more than MaxBlockTxs transactions.
+func (bc *Blockchain) checkBlockLimits(b Block) error {
+	if bc.MaxBlockSize > 0 {
+		if size := b.Size(); size > bc.MaxBlockSize {
+			return fmt.Errorf("block is %d bytes, over the %d byte limit", size, bc.MaxBlockSize)
+		}
+	}
+	if bc.MaxBlockTxs > 0 {
+		if n := len(b.Transactions()); n > bc.MaxBlockTxs {
+			return fmt.Errorf("block has %d transactions, over the limit of %d", n, bc.MaxBlockTxs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectTransactionsByFeeRate(t *testing.T) {
+	transfer := func(from string, nonce uint64, fee int64) Transaction {
+		return Transaction{FromAddress: from, ToAddress: "bob", Amount: 1, Fee: fee, Nonce: nonce, Timestamp: 1}
+	}
+	// Paying a long address makes a transaction larger, and so its fee
+	// rate lower.
+	large := transfer("dave", 0, 10)
+	large.ToAddress = strings.Repeat("b", 1000)
+
+	tests := []struct {
+		name     string
+		pending  []Transaction
+		wantFees []int64
+	}{
+		{
+			name:     "highest fee rate first",
+			pending:  []Transaction{transfer("alice", 0, 1), transfer("bob", 0, 5), transfer("carol", 0, 3)},
+			wantFees: []int64{5, 3, 1},
+		},
+		{
+			name:     "equal fee rates keep their order",
+			pending:  []Transaction{transfer("alice", 0, 2), transfer("bob", 0, 2), transfer("carol", 0, 2)},
+			wantFees: []int64{2, 2, 2},
+		},
+		{
+			name:     "a sender's nonces stay in order",
+			pending:  []Transaction{transfer("alice", 0, 1), transfer("alice", 1, 9), transfer("bob", 0, 5)},
+			wantFees: []int64{5, 1, 9},
+		},
+		{
+			name:     "fee rate rather than fee",
+			pending:  []Transaction{large, transfer("alice", 0, 8)},
+			wantFees: []int64{8, 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBlockchain(1, 50*UnitsPerCoin)
+			bc.MaxBlockTxs = 100 // any limit switches on packing by fee rate
+			bc.PendingTransactions = tt.pending
+			var fees []int64
+			for _, tx := range bc.selectTransactions(0, 0) {
+				fees = append(fees, tx.Fee)
+			}
+			if !reflect.DeepEqual(fees, tt.wantFees) {
+				t.Fatalf("picked fees %v, want %v", fees, tt.wantFees)
+			}
+		})
+	}
+}
+
+func TestMinedBlockPaysFeesToCoinbase(t *testing.T) {
+	bc, aliceKey, alice := fundedChain(t)
+	bobKey, bob := testKey(t)
+	carolKey, carol := testKey(t)
+	for _, addr := range []string{bob, carol} {
+		if _, err := bc.MinePendingTransactions(context.Background(), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tx := range []Transaction{
+		signedTransfer(aliceKey, alice, "dave", UnitsPerCoin, 1000, 0),
+		signedTransfer(bobKey, bob, "dave", UnitsPerCoin, 5000, 0),
+		signedTransfer(carolKey, carol, "dave", UnitsPerCoin, 3000, 0),
+	} {
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bc.MaxBlockTxs = 3 // the reward and two transfers
+	block, err := bc.MinePendingTransactions(context.Background(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := block.Transactions()
+	if len(txs) != 3 || txs[1].FromAddress != bob || txs[2].FromAddress != carol {
+		t.Fatalf("block holds %+v, want the reward and the transfers from bob and carol", txs)
+	}
+	want := bc.BlockSubsidy(len(bc.Chain)-1) + 8000
+	if txs[0].Amount != want || block.Fees() != 8000 {
+		t.Fatalf("reward is %d with %d in fees, want %d with 8000", txs[0].Amount, block.Fees(), want)
+	}
+	if got := bc.GetBalanceOfAddress("miner"); got != want {
+		t.Fatalf("miner balance = %d, want %d", got, want)
+	}
+	if len(bc.PendingTransactions) != 1 || bc.PendingTransactions[0].FromAddress != alice {
+		t.Fatalf("pending after mining = %+v, want alice's transfer", bc.PendingTransactions)
+	}
+	if err := bc.ValidateChain(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectTransactionsRespectsLimits(t *testing.T) {
+	transfer := func(from string, nonce uint64, fee int64) Transaction {
+		return Transaction{FromAddress: from, ToAddress: "bob", Amount: 1, Fee: fee, Nonce: nonce, Timestamp: 1}
+	}
+	small := transfer("alice", 0, 1)
+	size := small.Size()
+	large := transfer("alice", 0, 100)
+	large.ToAddress = strings.Repeat("b", 1000)
+
+	tests := []struct {
+		name          string
+		maxSize       int
+		maxTxs        int
+		reservedBytes int
+		reservedTxs   int
+		pending       []Transaction
+		wantFees      []int64
+	}{
+		{
+			name:        "transaction count, less the reward",
+			maxTxs:      3,
+			reservedTxs: 1,
+			pending:     []Transaction{transfer("alice", 0, 1), transfer("bob", 0, 5), transfer("carol", 0, 3)},
+			wantFees:    []int64{5, 3},
+		},
+		{
+			name:          "block size, less the header",
+			maxSize:       blockHeaderSize + 2*size,
+			reservedBytes: blockHeaderSize,
+			pending:       []Transaction{transfer("alice", 0, 1), transfer("bob", 0, 5), transfer("carol", 0, 3)},
+			wantFees:      []int64{5, 3},
+		},
+		{
+			name:     "a transaction that does not fit holds back its sender",
+			maxSize:  2 * size,
+			pending:  []Transaction{large, transfer("alice", 1, 9), transfer("bob", 0, 1)},
+			wantFees: []int64{1},
+		},
+		{
+			name:     "everything fits",
+			maxSize:  10 * size,
+			maxTxs:   10,
+			pending:  []Transaction{transfer("alice", 0, 1), transfer("bob", 0, 5)},
+			wantFees: []int64{5, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBlockchain(1, 50*UnitsPerCoin)
+			bc.MaxBlockSize = tt.maxSize
+			bc.MaxBlockTxs = tt.maxTxs
+			bc.PendingTransactions = tt.pending
+			var fees []int64
+			for _, tx := range bc.selectTransactions(tt.reservedBytes, tt.reservedTxs) {
+				fees = append(fees, tx.Fee)
+			}
+			if !reflect.DeepEqual(fees, tt.wantFees) {
+				t.Fatalf("picked fees %v, want %v", fees, tt.wantFees)
+			}
+		})
+	}
+}
+
+func TestBlockLimitsEnforced(t *testing.T) {
+	bc, key, addr := fundedChain(t)
+	for i := 0; i < 2; i++ {
+		if err := bc.AddTransaction(signedTransfer(key, addr, "bob", UnitsPerCoin, 0, uint64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block, err := bc.MinePendingTransactions(context.Background(), "miner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		maxSize int
+		maxTxs  int
+		wantErr string
+	}{
+		{name: "no limits"},
+		{name: "at the limits", maxSize: block.Size(), maxTxs: 3},
+		{name: "one byte over", maxSize: block.Size() - 1, wantErr: fmt.Sprintf("over the %d byte limit", block.Size()-1)},
+		{name: "one transaction over", maxTxs: 2, wantErr: "block has 3 transactions, over the limit of 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc.MaxBlockSize = tt.maxSize
+			bc.MaxBlockTxs = tt.maxTxs
+			checkErr(t, bc.ValidateChain(), tt.wantErr)
+		})
+	}
+
+	bc.MaxBlockSize = blockHeaderSize + 100
+	bc.MaxBlockTxs = 0
+	tx := signedTransfer(key, addr, "bob", UnitsPerCoin, 0, 2)
+	checkErr(t, bc.AddTransaction(tx), "too large to fit in any block")
+}
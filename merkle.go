@@ -0,0 +1,137 @@
+package main
+
+import "fmt"
+
+// MerkleStep is one level of an inclusion proof: the sibling hash and which
+// side of the running hash it sits on.
+type MerkleStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// taggedMerkleVersion is the first header version whose Merkle tree hashes
+// leaves and internal nodes with different prefixes. Without them an
+// internal node, which is just another 64-digit hash, could be passed off
+// as a transaction ID in an inclusion proof. Older headers keep the untagged
+// tree so blocks mined before the change still validate.
+const taggedMerkleVersion = 3
+
+// dataLeafVersion is the first header version whose Merkle tree also
+// commits to whatever a block carries besides its transactions, such as the
+// genesis spec stored next to the premine allocations. It is hashed as one
+// extra leaf after the transactions, so transaction positions and their
+// proofs are unchanged.
+const dataLeafVersion = 4
+
+const (
+	merkleLeafPrefix = "\x00"
+	merkleNodePrefix = "\x01"
+)
+
+// merkleLeafHash returns the tree node for a leaf under the given header
+// version.
+func merkleLeafHash(version uint32, leaf string) string {
+	if version < taggedMerkleVersion {
+		return leaf
+	}
+	return calculateSHA256(merkleLeafPrefix + leaf)
+}
+
+// merkleNodeHash returns the parent of two tree nodes under the given header
+// version.
+func merkleNodeHash(version uint32, left, right string) string {
+	if version < taggedMerkleVersion {
+		return calculateSHA256(left + right)
+	}
+	return calculateSHA256(merkleNodePrefix + left + right)
+}
+
+// merkleRoot computes the root of a binary Merkle tree over hex-encoded leaf
+// hashes. An odd node at the end of a level is paired with itself, as in
+// Bitcoin, so a list whose last leaves repeat can share a root with a shorter
+// one; block validation rejects repeated transactions for that reason. An
+// empty tree has the hash of the empty string as its root.
+func merkleRoot(version uint32, leaves []string) string {
+	if len(leaves) == 0 {
+		return calculateSHA256("")
+	}
+	level := merkleLeafLevel(version, leaves)
+	for len(level) > 1 {
+		level = nextMerkleLevel(version, level)
+	}
+	return level[0]
+}
+
+func merkleLeafLevel(version uint32, leaves []string) []string {
+	level := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeafHash(version, leaf)
+	}
+	return level
+}
+
+func nextMerkleLevel(version uint32, level []string) []string {
+	next := make([]string, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, merkleNodeHash(version, level[i], right))
+	}
+	return next
+}
+
+// merkleProof returns the sibling path from the leaf at index up to the root.
+func merkleProof(version uint32, leaves []string, index int) ([]MerkleStep, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range", index)
+	}
+	var path []MerkleStep
+	level := merkleLeafLevel(version, leaves)
+	for len(level) > 1 {
+		if index%2 == 0 {
+			sibling := level[index]
+			if index+1 < len(level) {
+				sibling = level[index+1]
+			}
+			path = append(path, MerkleStep{Hash: sibling, Left: false})
+		} else {
+			path = append(path, MerkleStep{Hash: level[index-1], Left: true})
+		}
+		level = nextMerkleLevel(version, level)
+		index /= 2
+	}
+	return path, nil
+}
+
+// verifyMerkleProof folds the proof path over the leaf and reports whether
+// it arrives at the expected root.
+func verifyMerkleProof(version uint32, leaf string, path []MerkleStep, root string) bool {
+	hash := merkleLeafHash(version, leaf)
+	for _, step := range path {
+		if step.Left {
+			hash = merkleNodeHash(version, step.Hash, hash)
+		} else {
+			hash = merkleNodeHash(version, hash, step.Hash)
+		}
+	}
+	return hash == root
+}
+
+// checkDuplicateTransactions rejects a block that lists the same transaction
+// twice. Because the odd node of a level is paired with itself, repeating the
+// last transactions of a block leaves its Merkle root, and so its hash,
+// unchanged (CVE-2012-2459); refusing repeats means a valid block and a
+// tampered copy can never share a hash.
+func checkDuplicateTransactions(b Block) error {
+	seen := make(map[string]bool)
+	for _, tx := range b.Transactions() {
+		id := tx.ID()
+		if seen[id] {
+			return fmt.Errorf("transaction %s appears more than once", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
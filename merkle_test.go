@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testLeaves(n int) []string {
+	leaves := make([]string, n)
+	for i := range leaves {
+		leaves[i] = calculateSHA256(fmt.Sprintf("tx %d", i))
+	}
+	return leaves
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	for _, version := range []uint32{2, BlockHeaderVersion} {
+		for n := 1; n <= 9; n++ {
+			leaves := testLeaves(n)
+			root := merkleRoot(version, leaves)
+			for i, leaf := range leaves {
+				path, err := merkleProof(version, leaves, i)
+				if err != nil {
+					t.Fatalf("v%d, %d leaves, leaf %d: %v", version, n, i, err)
+				}
+				if !verifyMerkleProof(version, leaf, path, root) {
+					t.Fatalf("v%d, %d leaves: proof for leaf %d does not verify", version, n, i)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejectsInternalNode(t *testing.T) {
+	leaves := testLeaves(4)
+	for _, tt := range []struct {
+		version uint32
+		want    bool
+	}{
+		{version: 2, want: true}, // the weakness the leaf and node prefixes remove
+		{version: BlockHeaderVersion, want: false},
+	} {
+		level := nextMerkleLevel(tt.version, merkleLeafLevel(tt.version, leaves))
+		root := merkleRoot(tt.version, leaves)
+		// Claim the left internal node is a transaction, proven by its sibling.
+		path := []MerkleStep{{Hash: level[1], Left: false}}
+		if got := verifyMerkleProof(tt.version, level[0], path, root); got != tt.want {
+			t.Errorf("v%d: internal node accepted as a leaf = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestDuplicateTransactionsRejected(t *testing.T) {
+	a := NewTransaction("alice", "bob", 1)
+	b := NewTransaction("alice", "bob", 2)
+	c := NewTransaction("alice", "bob", 3)
+
+	block := NewBlock(1, map[string]interface{}{"transactions": []Transaction{a, b, c}})
+	mutated := NewBlock(1, map[string]interface{}{"transactions": []Transaction{a, b, c, c}})
+	if block.MerkleRoot != mutated.MerkleRoot {
+		t.Fatalf("expected repeating the last transaction to keep the root")
+	}
+
+	if err := checkDuplicateTransactions(block); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := checkDuplicateTransactions(mutated); err == nil {
+		t.Fatalf("block repeating a transaction was accepted")
+	}
+}
+
+func TestCheckProofHeader(t *testing.T) {
+	bc := NewBlockchain(4, 50*UnitsPerCoin)
+	mineTransfer(t, bc, "miner", "", 0)
+	mined := blockToHeaderData(bc.Chain[1])
+	genesis := blockToHeaderData(bc.Chain[0])
+
+	key, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := signedHeader(t, key, mined.Hash, 0)
+	forged := sealed
+	if forged.Signature, err = signHash(other, sealed.Hash); err != nil {
+		t.Fatal(err)
+	}
+
+	// rehash recomputes the header's hash after a change, as a forger would.
+	rehash := func(h BlockHeaderData, change func(h *BlockHeaderData)) BlockHeaderData {
+		change(&h)
+		block := headerDataToBlock(h)
+		h.Hash = block.calculateHash()
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		header  BlockHeaderData
+		inChain bool
+		wantErr string
+	}{
+		{name: "mined", header: mined},
+		{name: "sealed", header: sealed},
+		{name: "genesis in the local chain", header: genesis, inChain: true},
+		{name: "genesis alone", header: genesis, wantErr: "genesis header"},
+		{
+			name: "hash not updated",
+			header: func() BlockHeaderData {
+				h := mined
+				h.MerkleRoot = calculateSHA256("other")
+				return h
+			}(),
+			wantErr: "does not match",
+		},
+		{
+			name:    "rehashed without mining",
+			header:  rehash(mined, func(h *BlockHeaderData) { h.MerkleRoot = calculateSHA256("other") }),
+			wantErr: "above its target",
+		},
+		{name: "seal by another key", header: forged, wantErr: "header seal"},
+		{
+			name:    "unsigned seal",
+			header:  func() BlockHeaderData { h := sealed; h.Signature = nil; return h }(),
+			wantErr: "header seal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErr(t, checkProofHeader(tt.header, tt.inChain), tt.wantErr)
+		})
+	}
+}
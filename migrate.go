@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// blockchainFormatVersion is written to the block store's meta file, and was
+// written to blockchain.json before the block store existed. Files without a
+// version field predate integer amounts and store every amount as a floating
+// point number of coins. Version 1 files may hold a mining reward in the
+// pending pool, from when rewards were paid in the following block.
+const blockchainFormatVersion = 2
+
+// migrateBlockchainData upgrades the contents of an older blockchain.json to
+// the current format. It returns the upgraded data and the version the file
+// was in before.
+func migrateBlockchainData(data []byte) ([]byte, int, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, 0, err
+	}
+	if probe.Version == blockchainFormatVersion {
+		return data, probe.Version, nil
+	}
+	if probe.Version > blockchainFormatVersion {
+		return nil, 0, fmt.Errorf("blockchain format version %d is newer than this build supports (%d)", probe.Version, blockchainFormatVersion)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, 0, err
+	}
+	if probe.Version < 1 {
+		if err := convertLegacyAmounts(doc); err != nil {
+			return nil, 0, err
+		}
+	}
+	if probe.Version < 2 {
+		dropPendingRewards(doc)
+	}
+	doc["version"] = blockchainFormatVersion
+
+	upgraded, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	return upgraded, probe.Version, nil
+}
+
+// dropPendingRewards removes mining rewards waiting in the pending pool.
+// Rewards are now part of the block they pay for, so a leftover one would
+// become a second coinbase in the next block.
+func dropPendingRewards(doc map[string]interface{}) {
+	pending, _ := doc["pending_transactions"].([]interface{})
+	kept := []interface{}{}
+	for _, v := range pending {
+		if tx, ok := v.(map[string]interface{}); ok && tx["from_address"] == "" {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	doc["pending_transactions"] = kept
+}
+
+// convertLegacyAmounts walks a decoded version 0 document and rewrites every
+// coin amount as integer base units.
+func convertLegacyAmounts(v interface{}) error {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if n, ok := child.(json.Number); ok && (k == "amount" || k == "mining_reward") {
+				coins, err := n.Float64()
+				if err != nil {
+					return fmt.Errorf("invalid %s %q: %v", k, n, err)
+				}
+				val[k] = coinsToUnits(coins)
+				continue
+			}
+			if err := convertLegacyAmounts(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range val {
+			if err := convertLegacyAmounts(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacyBlocksKey is the genesis data field recording how many blocks, from
+// genesis on, were migrated from a chain created before nonces. Keeping it in
+// the genesis block means the genesis hash commits to it.
+const legacyBlocksKey = "legacy_blocks"
+
+// legacyBlocks returns the number of blocks at the start of the chain that
+// were migrated from a chain created before nonces. Transactions in them are
+// checked against the signatures they were made with.
+func (bc *Blockchain) legacyBlocks() int {
+	switch n := bc.Chain[0].Data[legacyBlocksKey].(type) {
+	case int:
+		return n
+	case json.Number:
+		v, _ := n.Int64()
+		return int(v)
+	}
+	return 0
+}
+
+// convertLegacyTransactions prepares the transactions of a version 0 chain
+// for current validation. Senders' transactions get consecutive nonces in
+// chain order and coinbases the height of their block, as they would have
+// today; neither is covered by the old signatures, which are still checked
+// for the migrated blocks. Pending transactions are dropped, since a
+// signature without a nonce is not accepted in new blocks.
+func (bc *Blockchain) convertLegacyTransactions() {
+	nonces := make(map[string]uint64)
+	for height := 1; height < len(bc.Chain); height++ {
+		txs := bc.Chain[height].Transactions()
+		for i := range txs {
+			if isCoinbase(txs[i]) {
+				txs[i].Nonce = uint64(height)
+				continue
+			}
+			txs[i].Nonce = nonces[txs[i].FromAddress]
+			nonces[txs[i].FromAddress]++
+		}
+	}
+	bc.Chain[0].Data[legacyBlocksKey] = len(bc.Chain)
+	bc.PendingTransactions = []Transaction{}
+}
+
+// resealLegacyBlocks rebuilds the headers of blocks saved before blocks had
+// a binary header. Those blocks hashed a string of their fields, so their
+// stored hashes, Merkle roots and targets do not match anything validation
+// recomputes. Starting at the first block whose header does not check out,
+// every block gets a current header linked to the block before it, a
+// timestamp past the median time past and the required target, and is mined
+// again. Blocks after a rebuilt one are rebuilt too, since their previous
+// hash changes. Only proof of work blocks can be resealed this way.
+func (bc *Blockchain) resealLegacyBlocks() error {
+	rebuilt := false
+	for i := range bc.Chain {
+		if !rebuilt && bc.headerIntact(i) {
+			continue
+		}
+		rebuilt = true
+
+		block := &bc.Chain[i]
+		block.Version = BlockHeaderVersion
+		block.MerkleRoot = block.calculateMerkleRoot()
+		if i == 0 {
+			block.PrevHash = zeroHash
+			block.Bits = difficultyToBits(bc.Difficulty)
+			block.Hash = block.calculateHash()
+			continue
+		}
+		if bc.Engine().Name() != ConsensusPoW {
+			return fmt.Errorf("block %d: a %s block cannot be resealed", i, bc.Engine().Name())
+		}
+		block.PrevHash = bc.Chain[i-1].Hash
+		if mtp := bc.MedianTimePast(i); block.TimeStamp <= mtp {
+			block.TimeStamp = mtp + 1
+		}
+		block.Bits = bc.bitsAt(i)
+		block.Nonce = 0
+		if err := bc.Engine().Seal(context.Background(), bc, block); err != nil {
+			return fmt.Errorf("block %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// headerIntact reports whether the block at height has a header in a
+// supported version that matches its contents and links to its parent.
+func (bc *Blockchain) headerIntact(height int) bool {
+	block := bc.Chain[height]
+	if block.Version < minBlockHeaderVersion || block.Version > BlockHeaderVersion {
+		return false
+	}
+	if block.MerkleRoot != block.calculateMerkleRoot() || block.Hash != block.calculateHash() {
+		return false
+	}
+	if height == 0 {
+		return true
+	}
+	return block.PrevHash == bc.Chain[height-1].Hash && bc.Engine().VerifySeal(bc, height) == nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/baseline-blockchain.json was written by the first release: two
+// empty mines followed by a transfer of 12.5 coins, with amounts as floats
+// and blocks hashed over a string of their fields.
+const baselineFixture = "testdata/baseline-blockchain.json"
+
+func TestMigrateBaselineChain(t *testing.T) {
+	bc, fromVersion, err := readBlockchainFile(baselineFixture)
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if fromVersion != 0 {
+		t.Fatalf("fixture read as version %d, want 0", fromVersion)
+	}
+	if err := bc.ValidateChain(); err != nil {
+		t.Fatalf("migrated chain does not validate: %v", err)
+	}
+	if got := bc.legacyBlocks(); got != len(bc.Chain) {
+		t.Errorf("legacy blocks = %d, want %d", got, len(bc.Chain))
+	}
+
+	transfer := bc.Chain[3].Transactions()[1]
+	if transfer.Amount != 12_500_000 {
+		t.Errorf("transfer amount = %d units, want 12500000", transfer.Amount)
+	}
+	if got := bc.GetBalanceOfAddress(transfer.ToAddress); got != transfer.Amount {
+		t.Errorf("recipient balance = %d, want %d", got, transfer.Amount)
+	}
+}
+
+func TestMigrateBaselineChainChecksOldSignatures(t *testing.T) {
+	data, err := os.ReadFile(baselineFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(data), `"amount": 12.5`, `"amount": 99`, 1)
+	path := filepath.Join(t.TempDir(), blockchainFile)
+	if err := os.WriteFile(path, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bc, _, err := readBlockchainFile(path)
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	if err := bc.ValidateChain(); err == nil {
+		t.Fatalf("chain with an altered legacy transfer validated")
+	}
+}
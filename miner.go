@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MinerStats is a snapshot of mining progress.
+type MinerStats struct {
+	Hashes   uint64
+	Elapsed  time.Duration
+	HashRate float64 // hashes per second
+	Done     bool    // set on the final report, once mining has stopped
+}
+
+// Miner searches for a proof-of-work nonce using several goroutines. Worker i
+// of n tries nonces i, i+n, i+2n, ... so the workers never overlap.
+// OnProgress, if set, is called every ProgressInterval and once more when
+// mining stops.
+type Miner struct {
+	Threads          int
+	ProgressInterval time.Duration
+	OnProgress       func(MinerStats)
+}
+
+// NewMiner returns a miner with the given number of workers. A count of zero
+// or less uses one worker per CPU.
+func NewMiner(threads int) *Miner {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &Miner{Threads: threads, ProgressInterval: time.Second}
+}
+
+// hashBatch is how many nonces a worker tries between checks for
+// cancellation and updates to the shared hash counter.
+const hashBatch = 1024
+
+// Mine finds a nonce that brings the block's hash at or below the target in
+// b.Bits and stores the nonce and hash in the block. It returns ctx.Err() if
+// the context is cancelled first, leaving the block unchanged.
+func (m *Miner) Mine(ctx context.Context, b *Block) (MinerStats, error) {
+	header, err := b.encodeHeader()
+	if err != nil {
+		return MinerStats{}, err
+	}
+	target := make([]byte, 32)
+	compactToTarget(b.Bits).FillBytes(target)
+
+	threads := m.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		hashes   atomic.Uint64
+		once     sync.Once
+		found    uint64
+		foundSum []byte
+		wg       sync.WaitGroup
+	)
+	start := time.Now()
+	stats := func() MinerStats {
+		elapsed := time.Since(start)
+		n := hashes.Load()
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(n) / elapsed.Seconds()
+		}
+		return MinerStats{Hashes: n, Elapsed: elapsed, HashRate: rate}
+	}
+
+	for w := 0; w < threads; w++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+			buf := append([]byte(nil), header...)
+			for {
+				for i := 0; i < hashBatch; i++ {
+					binary.BigEndian.PutUint64(buf[80:88], nonce)
+					sum := sha256.Sum256(buf)
+					if bytes.Compare(sum[:], target) <= 0 {
+						hashes.Add(uint64(i + 1))
+						once.Do(func() {
+							found = nonce
+							foundSum = sum[:]
+							cancel()
+						})
+						return
+					}
+					nonce += uint64(threads)
+				}
+				hashes.Add(hashBatch)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}(uint64(w))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if m.OnProgress != nil && m.ProgressInterval > 0 {
+		ticker := time.NewTicker(m.ProgressInterval)
+		defer ticker.Stop()
+	progress:
+		for {
+			select {
+			case <-done:
+				break progress
+			case <-ticker.C:
+				m.OnProgress(stats())
+			}
+		}
+	}
+	<-done
+
+	final := stats()
+	final.Done = true
+	if m.OnProgress != nil {
+		m.OnProgress(final)
+	}
+	if foundSum == nil {
+		return final, context.Cause(ctx)
+	}
+	b.Nonce = int(found)
+	b.Hash = hex.EncodeToString(foundSum)
+	return final, nil
+}
+
+// formatHashRate renders a hash rate with a metric prefix, e.g. "1.25 MH/s".
+func formatHashRate(rate float64) string {
+	units := []string{"H/s", "kH/s", "MH/s", "GH/s"}
+	i := 0
+	for rate >= 1000 && i < len(units)-1 {
+		rate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
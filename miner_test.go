@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// unminedBlock returns a block on top of the default genesis block with the
+// given number of leading zero hex digits as its target.
+func unminedBlock(zeros int) Block {
+	genesis := DefaultGenesis().Block(ModelAccount)
+	block := NewBlock(genesis.TimeStamp+1, map[string]interface{}{"transactions": []Transaction{}})
+	block.PrevHash = genesis.Hash
+	block.Bits = difficultyToBits(zeros)
+	return block
+}
+
+func TestMinerFindsNonce(t *testing.T) {
+	for _, threads := range []int{1, 2, 4, 7} {
+		block := unminedBlock(3)
+		var reports []MinerStats
+		miner := NewMiner(threads)
+		miner.OnProgress = func(s MinerStats) { reports = append(reports, s) }
+		stats, err := miner.Mine(context.Background(), &block)
+		if err != nil {
+			t.Fatalf("%d threads: %v", threads, err)
+		}
+		if block.Hash != block.calculateHash() || !hashMeetsTarget(block.Hash, block.Bits) {
+			t.Fatalf("%d threads: nonce %d gives hash %s, which is not a valid seal", threads, block.Nonce, block.Hash)
+		}
+		if threads == 1 && stats.Hashes != uint64(block.Nonce)+1 {
+			t.Errorf("one thread counted %d hashes to find nonce %d", stats.Hashes, block.Nonce)
+		}
+		if len(reports) == 0 || !reports[len(reports)-1].Done || reports[len(reports)-1] != stats {
+			t.Errorf("%d threads: last progress report %+v, want the final stats %+v", threads, reports, stats)
+		}
+	}
+}
+
+func TestMinerCancellation(t *testing.T) {
+	tests := []struct {
+		name  string
+		after time.Duration // how long to mine before cancelling; 0 cancels first
+	}{
+		{name: "cancelled before mining"},
+		{name: "cancelled while mining", after: 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No nonce reaches 32 leading zero digits.
+			block := unminedBlock(32)
+			before := block
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.after == 0 {
+				cancel()
+			} else {
+				time.AfterFunc(tt.after, cancel)
+			}
+			start := time.Now()
+			_, err := NewMiner(4).Mine(ctx, &block)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got error %v, want %v", err, context.Canceled)
+			}
+			if waited := time.Since(start); waited > tt.after+time.Second {
+				t.Errorf("mining took %v to stop after being cancelled", waited-tt.after)
+			}
+			if block.Nonce != before.Nonce || block.Hash != before.Hash {
+				t.Errorf("cancelled mining changed the block to nonce %d, hash %s", block.Nonce, block.Hash)
+			}
+		})
+	}
+}
+
+func TestMinerReportsHashRate(t *testing.T) {
+	block := unminedBlock(32)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var reports []MinerStats
+	miner := NewMiner(2)
+	miner.ProgressInterval = 20 * time.Millisecond
+	miner.OnProgress = func(s MinerStats) { reports = append(reports, s) }
+	if _, err := miner.Mine(ctx, &block); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if len(reports) < 3 {
+		t.Fatalf("got %d progress reports in 200ms at a 20ms interval", len(reports))
+	}
+	for i, s := range reports {
+		if done := i == len(reports)-1; s.Done != done {
+			t.Errorf("report %d has Done = %v", i, s.Done)
+		}
+		if i > 0 && (s.Hashes < reports[i-1].Hashes || s.Elapsed < reports[i-1].Elapsed) {
+			t.Errorf("report %d went backwards: %+v after %+v", i, s, reports[i-1])
+		}
+		if want := float64(s.Hashes) / s.Elapsed.Seconds(); s.HashRate != want {
+			t.Errorf("report %d: hash rate %.0f, want %d hashes over %v = %.0f", i, s.HashRate, s.Hashes, s.Elapsed, want)
+		}
+	}
+	if final := reports[len(reports)-1]; final.Hashes == 0 {
+		t.Errorf("no hashes counted in %v", final.Elapsed)
+	}
+}
+
+func TestFormatHashRate(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want string
+	}{
+		{0, "0.00 H/s"},
+		{999, "999.00 H/s"},
+		{1250, "1.25 kH/s"},
+		{3_500_000, "3.50 MH/s"},
+		{2e12, "2000.00 GH/s"},
+	}
+	for _, tt := range tests {
+		if got := formatHashRate(tt.rate); got != tt.want {
+			t.Errorf("formatHashRate(%v) = %q, want %q", tt.rate, got, tt.want)
+		}
+	}
+}
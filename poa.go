@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Proof-of-authority difficulties, as in Clique: a block sealed by the signer
+// whose turn it is counts for more than one sealed out of turn, so when two
+// signers race the in-turn chain is heavier.
+const (
+	diffInTurn = 2
+	diffNoTurn = 1
+)
+
+// ProofOfAuthority lets a set of signers take turns sealing blocks instead of
+// mining them. The set starts as the chain's configured Signers and changes
+// through vote transactions. Signer i of n (sorted by address) is in turn
+// for heights where height % n == i, but any signer may seal as long as it
+// hasn't sealed one of the last n/2 blocks. Key is the local signer's key;
+// it is only needed to seal.
+type ProofOfAuthority struct {
+	Key *ecdsa.PrivateKey
+
+	// Signer set before block cacheHeight, whose parent had hash cacheHash.
+	// Validation walks the chain in order, so each block's votes are only
+	// replayed once.
+	cache       *signerSnapshot
+	cacheHeight int
+	cacheHash   string
+}
+
+func (e *ProofOfAuthority) Name() string {
+	return ConsensusPoA
+}
+
+// Difficulty returns diffInTurn if it is the local signer's turn at height
+// and diffNoTurn otherwise.
+func (e *ProofOfAuthority) Difficulty(bc *Blockchain, height int) uint32 {
+	if e.Key == nil {
+		return diffNoTurn
+	}
+	signer, err := addressFromKey(&e.Key.PublicKey)
+	if err != nil {
+		return diffNoTurn
+	}
+	snap, err := e.snapshotAt(bc, height)
+	if err != nil || !snap.inTurn(height, signer) {
+		return diffNoTurn
+	}
+	return diffInTurn
+}
+
+// Seal signs the block with the local signer's key.
+func (e *ProofOfAuthority) Seal(ctx context.Context, bc *Blockchain, block *Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if e.Key == nil {
+		return fmt.Errorf("proof of authority needs a signing key to seal blocks")
+	}
+	signer, err := addressFromKey(&e.Key.PublicKey)
+	if err != nil {
+		return err
+	}
+	height := len(bc.Chain)
+	snap, err := e.snapshotAt(bc, height)
+	if err != nil {
+		return err
+	}
+	if err := checkSigner(bc, snap, height, signer); err != nil {
+		return err
+	}
+
+	block.Signer = signer
+	block.Nonce = 0
+	block.Hash = block.calculateHash()
+	block.Signature, err = signHash(e.Key, block.Hash)
+	return err
+}
+
+// VerifySeal checks that the block was signed by an authorized signer who
+// was allowed to seal at that height, that its difficulty matches whether
+// the signer was in turn, and that any votes it carries are valid.
+func (e *ProofOfAuthority) VerifySeal(bc *Blockchain, height int) error {
+	block := bc.Chain[height]
+	if block.Signer == "" || len(block.Signature) == 0 {
+		return fmt.Errorf("block is not signed")
+	}
+	if err := verifyHashSignature(block.Signer, block.Hash, block.Signature); err != nil {
+		return fmt.Errorf("bad seal: %v", err)
+	}
+
+	snap, err := e.snapshotAt(bc, height)
+	if err != nil {
+		return err
+	}
+	if err := checkSigner(bc, snap, height, block.Signer); err != nil {
+		return err
+	}
+	want := uint32(diffNoTurn)
+	if snap.inTurn(height, block.Signer) {
+		want = diffInTurn
+	}
+	if block.Bits != want {
+		return fmt.Errorf("difficulty %d does not match required difficulty %d", block.Bits, want)
+	}
+
+	for _, tx := range block.Transactions() {
+		if tx.Type == TxTypeVote {
+			if err := snap.applyVote(tx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BlockWork is the block's difficulty: 2 in turn, 1 out of turn.
+func (e *ProofOfAuthority) BlockWork(bits uint32) *big.Int {
+	return big.NewInt(int64(bits))
+}
+
+// checkSigner verifies that signer may seal the block at height: it must be
+// authorized and must not have sealed any of the previous n/2 blocks, so no
+// single signer can take over the chain.
+func checkSigner(bc *Blockchain, snap *signerSnapshot, height int, signer string) error {
+	if !snap.signers[signer] {
+		return fmt.Errorf("%s is not an authorized signer", formatAddress(signer))
+	}
+	limit := len(snap.signers)/2 + 1
+	for h := max(1, height-limit+1); h < height; h++ {
+		if bc.Chain[h].Signer == signer {
+			return fmt.Errorf("%s sealed block %d and must wait for %d other signer(s)", formatAddress(signer), h, limit-1)
+		}
+	}
+	return nil
+}
+
+// snapshotAt returns the signer set in effect for the block at height: the
+// configured signers with the votes in blocks 1..height-1 applied.
+func (e *ProofOfAuthority) snapshotAt(bc *Blockchain, height int) (*signerSnapshot, error) {
+	if e.cache == nil || e.cacheHeight > height || e.cacheHeight > len(bc.Chain) ||
+		bc.Chain[e.cacheHeight-1].Hash != e.cacheHash {
+		e.cache = newSignerSnapshot(bc.Signers)
+		e.cacheHeight = 1
+		e.cacheHash = bc.Chain[0].Hash
+	}
+	for e.cacheHeight < height && e.cacheHeight < len(bc.Chain) {
+		for _, tx := range bc.Chain[e.cacheHeight].Transactions() {
+			if tx.Type != TxTypeVote {
+				continue
+			}
+			if err := e.cache.applyVote(tx); err != nil {
+				e.cache = nil
+				return nil, fmt.Errorf("block %d: %v", e.cacheHeight, err)
+			}
+		}
+		e.cacheHash = bc.Chain[e.cacheHeight].Hash
+		e.cacheHeight++
+	}
+	return e.cache.copy(), nil
+}
+
+// CurrentSigners returns the sorted signer set for the next block.
+func (e *ProofOfAuthority) CurrentSigners(bc *Blockchain) ([]string, error) {
+	snap, err := e.snapshotAt(bc, len(bc.Chain))
+	if err != nil {
+		return nil, err
+	}
+	return snap.sorted(), nil
+}
+
+// signerSnapshot is the authorized signer set at some height together with
+// the votes cast so far that have not yet reached a majority.
+type signerSnapshot struct {
+	signers map[string]bool
+	votes   map[string]map[string]string // candidate -> voter -> VoteAdd or VoteRemove
+}
+
+func newSignerSnapshot(signers []string) *signerSnapshot {
+	s := &signerSnapshot{signers: make(map[string]bool), votes: make(map[string]map[string]string)}
+	for _, signer := range signers {
+		s.signers[signer] = true
+	}
+	return s
+}
+
+func (s *signerSnapshot) copy() *signerSnapshot {
+	c := &signerSnapshot{signers: make(map[string]bool), votes: make(map[string]map[string]string)}
+	for signer := range s.signers {
+		c.signers[signer] = true
+	}
+	for candidate, votes := range s.votes {
+		c.votes[candidate] = make(map[string]string)
+		for voter, vote := range votes {
+			c.votes[candidate][voter] = vote
+		}
+	}
+	return c
+}
+
+func (s *signerSnapshot) sorted() []string {
+	list := make([]string, 0, len(s.signers))
+	for signer := range s.signers {
+		list = append(list, signer)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *signerSnapshot) inTurn(height int, signer string) bool {
+	list := s.sorted()
+	return len(list) > 0 && list[height%len(list)] == signer
+}
+
+// checkVote verifies that a vote is cast by a current signer and proposes an
+// actual change to the signer set.
+func (s *signerSnapshot) checkVote(tx Transaction) error {
+	if !s.signers[tx.FromAddress] {
+		return fmt.Errorf("%s is not a signer and cannot vote", formatAddress(tx.FromAddress))
+	}
+	switch tx.Payload {
+	case VoteAdd:
+		if s.signers[tx.ToAddress] {
+			return fmt.Errorf("%s is already a signer", formatAddress(tx.ToAddress))
+		}
+		if _, err := publicKeyFromAddress(tx.ToAddress); err != nil {
+			return fmt.Errorf("cannot vote for %s: %v", formatAddress(tx.ToAddress), err)
+		}
+	case VoteRemove:
+		if !s.signers[tx.ToAddress] {
+			return fmt.Errorf("%s is not a signer", formatAddress(tx.ToAddress))
+		}
+		if len(s.signers) == 1 {
+			return fmt.Errorf("cannot remove the last signer")
+		}
+	}
+	return nil
+}
+
+// applyVote records a vote, replacing the voter's earlier vote on the same
+// candidate. Once more than half of the signers agree, the candidate is
+// added or removed and the votes about it are cleared. A removed signer's
+// own pending votes are discarded.
+func (s *signerSnapshot) applyVote(tx Transaction) error {
+	if err := s.checkVote(tx); err != nil {
+		return err
+	}
+	candidate := tx.ToAddress
+	if s.votes[candidate] == nil {
+		s.votes[candidate] = make(map[string]string)
+	}
+	s.votes[candidate][tx.FromAddress] = tx.Payload
+
+	agree := 0
+	for _, vote := range s.votes[candidate] {
+		if vote == tx.Payload {
+			agree++
+		}
+	}
+	if agree <= len(s.signers)/2 {
+		return nil
+	}
+
+	delete(s.votes, candidate)
+	if tx.Payload == VoteAdd {
+		s.signers[candidate] = true
+		return nil
+	}
+	delete(s.signers, candidate)
+	for _, votes := range s.votes {
+		delete(votes, candidate)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+// testAddresses returns n fresh addresses in sorted order.
+func testAddresses(t *testing.T, n int) []string {
+	t.Helper()
+	addrs := make([]string, n)
+	for i := range addrs {
+		_, pub, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs[i], err = addressFromKey(pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestSignerInTurn(t *testing.T) {
+	signers := testAddresses(t, 3)
+	snap := newSignerSnapshot([]string{signers[2], signers[0], signers[1]})
+	for height := 0; height < 9; height++ {
+		for i, signer := range signers {
+			if got, want := snap.inTurn(height, signer), height%3 == i; got != want {
+				t.Errorf("height %d, signer %d: in turn = %v, want %v", height, i, got, want)
+			}
+		}
+	}
+}
+
+func TestCheckSignerRecentSeal(t *testing.T) {
+	s := testAddresses(t, 4)
+	tests := []struct {
+		name    string
+		signers []string
+		sealed  []string // signers of blocks 1, 2, ...
+		signer  string
+		wantErr string
+	}{
+		{name: "first block", signers: s[:3], sealed: nil, signer: s[0]},
+		{name: "sealed the previous block", signers: s[:3], sealed: []string{s[0]}, signer: s[0], wantErr: "must wait"},
+		{name: "waited one block of three", signers: s[:3], sealed: []string{s[0], s[1]}, signer: s[0]},
+		{name: "four signers wait two blocks", signers: s, sealed: []string{s[0], s[1]}, signer: s[0], wantErr: "must wait"},
+		{name: "four signers after two blocks", signers: s, sealed: []string{s[0], s[1], s[2]}, signer: s[0]},
+		{name: "lone signer seals every block", signers: s[:1], sealed: []string{s[0], s[0]}, signer: s[0]},
+		{name: "not a signer", signers: s[:3], sealed: nil, signer: s[3], wantErr: "not an authorized signer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := &Blockchain{Chain: []Block{{}}}
+			for _, signer := range tt.sealed {
+				bc.Chain = append(bc.Chain, Block{Signer: signer})
+			}
+			checkErr(t, checkSigner(bc, newSignerSnapshot(tt.signers), len(bc.Chain), tt.signer), tt.wantErr)
+		})
+	}
+}
+
+func TestSignerVotesChangeRotation(t *testing.T) {
+	s := testAddresses(t, 4)
+	vote := func(from, candidate, payload string) Transaction {
+		return Transaction{FromAddress: from, ToAddress: candidate, Type: TxTypeVote, Payload: payload}
+	}
+
+	snap := newSignerSnapshot(s[:3])
+	// One vote of three is not a majority.
+	if err := snap.applyVote(vote(s[0], s[3], VoteAdd)); err != nil {
+		t.Fatal(err)
+	}
+	if snap.signers[s[3]] {
+		t.Fatalf("signer added after one vote of three")
+	}
+	if err := snap.applyVote(vote(s[1], s[3], VoteAdd)); err != nil {
+		t.Fatal(err)
+	}
+	if !snap.signers[s[3]] {
+		t.Fatalf("signer not added after two votes of three")
+	}
+	if !snap.inTurn(3, s[3]) {
+		t.Errorf("new signer is not in turn at height 3 of 4")
+	}
+
+	// Removing needs three votes of four; the removed signer leaves the
+	// rotation.
+	for _, voter := range s[1:4] {
+		if err := snap.applyVote(vote(voter, s[0], VoteRemove)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if snap.signers[s[0]] {
+		t.Fatalf("signer not removed after three votes of four")
+	}
+	if got := snap.sorted(); len(got) != 3 || !snap.inTurn(0, s[1]) {
+		t.Errorf("rotation after removal is %v", got)
+	}
+
+	if err := snap.applyVote(vote(s[0], s[1], VoteRemove)); err == nil {
+		t.Errorf("removed signer was allowed to vote")
+	}
+}
+
+func TestHeaderCommitsToSigner(t *testing.T) {
+	s := testAddresses(t, 2)
+	tests := []struct {
+		name    string
+		version uint32
+		commits bool
+	}{
+		{name: "before the signer was hashed", version: signerHeaderVersion - 1, commits: false},
+		{name: "current version", version: BlockHeaderVersion, commits: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := NewBlock(1000, map[string]interface{}{"transactions": []Transaction{}})
+			block.Version = tt.version
+			block.PrevHash = zeroHash
+			block.Signer = s[0]
+			first := block.calculateHash()
+			block.Signer = s[1]
+			second := block.calculateHash()
+			if first == "" || second == "" {
+				t.Fatalf("header does not encode")
+			}
+			if (first != second) != tt.commits {
+				t.Fatalf("re-sealing by another signer changed the hash: %v, want %v", first != second, tt.commits)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// posRoundTime is how many seconds each proposer round lasts. If the round 0
+// proposer for a height doesn't produce a block, the round 1 proposer may
+// do so once posRoundTime seconds have passed since the previous block, and
+// so on, so one offline validator cannot stall the chain.
+const posRoundTime = 10
+
+// posMaxRounds bounds the proposer rounds of a height: NextRound looks this
+// far ahead for a validator's turn, and blocks sealed in a later round are
+// rejected.
+const posMaxRounds = 1000
+
+// ProofOfStake picks each block's proposer pseudo-randomly, weighted by how
+// many coins each address has locked as stake. The choice is seeded from the
+// previous block's hash, so every node computes the same proposer. The
+// proposer signs the block like a proof-of-authority signer and records the
+// round in the block's Nonce. Key is the local validator's key; it is only
+// needed to seal.
+type ProofOfStake struct {
+	Key *ecdsa.PrivateKey
+
+	// Ledger state before block cacheHeight, whose parent had hash cacheHash.
+	cache       *chainState
+	cacheHeight int
+	cacheHash   string
+}
+
+func (e *ProofOfStake) Name() string {
+	return ConsensusPoS
+}
+
+// Difficulty is always 1: every proof-of-stake block carries the same
+// weight, so the longest chain is the heaviest.
+func (e *ProofOfStake) Difficulty(bc *Blockchain, height int) uint32 {
+	return 1
+}
+
+// Seal waits for the first round in which the local validator is the
+// proposer, moves the block's timestamp up to when that round opens if
+// needed, and signs it.
+func (e *ProofOfStake) Seal(ctx context.Context, bc *Blockchain, block *Block) error {
+	if e.Key == nil {
+		return fmt.Errorf("proof of stake needs a validator key to seal blocks")
+	}
+	me, err := addressFromKey(&e.Key.PublicKey)
+	if err != nil {
+		return err
+	}
+	round, opens, err := e.NextRound(bc, me)
+	if err != nil {
+		return err
+	}
+
+	if wait := time.Until(time.Unix(opens, 0)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if block.TimeStamp < opens {
+		block.TimeStamp = opens
+	}
+	block.Signer = me
+	block.Nonce = round
+	block.Hash = block.calculateHash()
+	block.Signature, err = signHash(e.Key, block.Hash)
+	return err
+}
+
+// NextRound returns the first round of the next block that validator may
+// propose and the time that round opens.
+func (e *ProofOfStake) NextRound(bc *Blockchain, validator string) (int, int64, error) {
+	height := len(bc.Chain)
+	stakes, err := e.stakesAt(bc, height)
+	if err != nil {
+		return 0, 0, err
+	}
+	if stakes[validator] <= 0 {
+		return 0, 0, fmt.Errorf("%s has no stake and cannot propose blocks", formatAddress(validator))
+	}
+	prev := bc.Chain[height-1]
+	for round := 0; round < posMaxRounds; round++ {
+		proposer, err := selectProposer(stakes, prev.Hash, height, round)
+		if err != nil {
+			return 0, 0, err
+		}
+		if proposer == validator {
+			return round, prev.TimeStamp + int64(round)*posRoundTime, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%s is not chosen in the next %d rounds", formatAddress(validator), posMaxRounds)
+}
+
+// VerifySeal checks the proposer's signature and that the proposer was the
+// one chosen for the block's height and round, and that the round had
+// opened by the block's timestamp.
+func (e *ProofOfStake) VerifySeal(bc *Blockchain, height int) error {
+	block := bc.Chain[height]
+	prev := bc.Chain[height-1]
+	if block.Signer == "" || len(block.Signature) == 0 {
+		return fmt.Errorf("block is not signed")
+	}
+	if err := verifyHashSignature(block.Signer, block.Hash, block.Signature); err != nil {
+		return fmt.Errorf("bad seal: %v", err)
+	}
+	if block.Bits != 1 {
+		return fmt.Errorf("difficulty %d does not match required difficulty 1", block.Bits)
+	}
+
+	round := block.Nonce
+	if round < 0 || round >= posMaxRounds {
+		return fmt.Errorf("invalid round %d", round)
+	}
+	if opens := prev.TimeStamp + int64(round)*posRoundTime; block.TimeStamp < opens {
+		return fmt.Errorf("round %d does not open until %d", round, opens)
+	}
+
+	stakes, err := e.stakesAt(bc, height)
+	if err != nil {
+		return err
+	}
+	proposer, err := selectProposer(stakes, prev.Hash, height, round)
+	if err != nil {
+		return err
+	}
+	if block.Signer != proposer {
+		return fmt.Errorf("round %d must be proposed by %s, not %s", round, formatAddress(proposer), formatAddress(block.Signer))
+	}
+	return nil
+}
+
+func (e *ProofOfStake) BlockWork(bits uint32) *big.Int {
+	return big.NewInt(int64(bits))
+}
+
+// stakesAt returns each address's stake before the block at height.
+func (e *ProofOfStake) stakesAt(bc *Blockchain, height int) (map[string]int64, error) {
+	if e.cache == nil || e.cacheHeight > height || e.cacheHeight > len(bc.Chain) ||
+		bc.Chain[e.cacheHeight-1].Hash != e.cacheHash {
+		e.cache = bc.initialState()
+		e.cacheHeight = 1
+		e.cacheHash = bc.Chain[0].Hash
+	}
+	for e.cacheHeight < height && e.cacheHeight < len(bc.Chain) {
+		for _, tx := range bc.Chain[e.cacheHeight].Transactions() {
+			if err := e.cache.applyTransaction(tx); err != nil {
+				e.cache = nil
+				return nil, fmt.Errorf("block %d: %v", e.cacheHeight, err)
+			}
+		}
+		e.cacheHash = bc.Chain[e.cacheHeight].Hash
+		e.cacheHeight++
+	}
+
+	stakes := make(map[string]int64, len(e.cache.stakes))
+	for addr, stake := range e.cache.stakes {
+		if stake > 0 {
+			stakes[addr] = stake
+		}
+	}
+	return stakes, nil
+}
+
+// Stakes returns the current stake of every validator.
+func (e *ProofOfStake) Stakes(bc *Blockchain) (map[string]int64, error) {
+	return e.stakesAt(bc, len(bc.Chain))
+}
+
+// selectProposer picks a validator with probability proportional to its
+// stake. The random number is the hash of the seed (the previous block's
+// hash), the height and the round, reduced modulo the total stake, and
+// lands in the range of one validator when stakes are laid end to end in
+// address order.
+func selectProposer(stakes map[string]int64, seed string, height, round int) (string, error) {
+	addrs := make([]string, 0, len(stakes))
+	var total int64
+	for addr, stake := range stakes {
+		addrs = append(addrs, addr)
+		total += stake
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("no validator has any stake")
+	}
+	sort.Strings(addrs)
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", seed, height, round)))
+	pick := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), big.NewInt(total)).Int64()
+	for _, addr := range addrs {
+		if pick < stakes[addr] {
+			return addr, nil
+		}
+		pick -= stakes[addr]
+	}
+	return addrs[len(addrs)-1], nil
+}
+
+// DoubleSignEvidence proves that a validator signed two different blocks on
+// the same parent, i.e. at the same height. It is carried as the payload of
+// an evidence transaction, which slashes the offender's whole stake.
+type DoubleSignEvidence struct {
+	First  BlockHeaderData `json:"first"`
+	Second BlockHeaderData `json:"second"`
+}
+
+// parseEvidence decodes an evidence payload and returns it together with the
+// offending validator.
+func parseEvidence(payload string) (DoubleSignEvidence, string, error) {
+	var ev DoubleSignEvidence
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+		return ev, "", fmt.Errorf("invalid evidence: %v", err)
+	}
+	offender, err := ev.verify()
+	return ev, offender, err
+}
+
+// verify checks that both headers are genuine, signed by the same validator
+// on the same parent, and differ.
+func (ev DoubleSignEvidence) verify() (string, error) {
+	headers := []BlockHeaderData{ev.First, ev.Second}
+	for _, h := range headers {
+		if h.Signer == "" || len(h.Signature) == 0 {
+			return "", fmt.Errorf("evidence header is not signed")
+		}
+		block := headerDataToBlock(h)
+		if block.calculateHash() != h.Hash {
+			return "", fmt.Errorf("evidence header %s does not match its hash", formatAddress(h.Hash))
+		}
+		if err := verifyHashSignature(h.Signer, h.Hash, h.Signature); err != nil {
+			return "", fmt.Errorf("evidence header %s: %v", formatAddress(h.Hash), err)
+		}
+	}
+	if ev.First.Signer != ev.Second.Signer {
+		return "", fmt.Errorf("evidence headers have different signers")
+	}
+	if ev.First.PrevHash != ev.Second.PrevHash {
+		return "", fmt.Errorf("evidence headers are not at the same height")
+	}
+	if ev.First.Hash == ev.Second.Hash {
+		return "", fmt.Errorf("evidence headers are the same block")
+	}
+	return ev.First.Signer, nil
+}
+
+// key identifies the offence, so the same double-sign is only slashed once.
+func (ev DoubleSignEvidence) key() string {
+	return ev.First.Signer + ":" + ev.First.PrevHash
+}
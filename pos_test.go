@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"testing"
+)
+
+func TestSelectProposerDeterministic(t *testing.T) {
+	stakes := map[string]int64{"alice": 100, "bob": 300, "carol": 600}
+	first, err := selectProposer(stakes, "seed", 7, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		// A fresh map each time, so iteration order differs between calls.
+		copied := make(map[string]int64, len(stakes))
+		for addr, stake := range stakes {
+			copied[addr] = stake
+		}
+		got, err := selectProposer(copied, "seed", 7, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != first {
+			t.Fatalf("call %d picked %s, the first picked %s", i, got, first)
+		}
+	}
+}
+
+func TestSelectProposer(t *testing.T) {
+	tests := []struct {
+		name    string
+		stakes  map[string]int64
+		wantErr bool
+		only    string // the one validator that can ever be picked
+	}{
+		{name: "no validators", stakes: map[string]int64{}, wantErr: true},
+		{name: "no stake", stakes: map[string]int64{"alice": 0}, wantErr: true},
+		{name: "single validator", stakes: map[string]int64{"alice": 5}, only: "alice"},
+		{name: "zero stake is never picked", stakes: map[string]int64{"alice": 0, "bob": 5}, only: "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for height := 1; height <= 20; height++ {
+				got, err := selectProposer(tt.stakes, "seed", height, 0)
+				if tt.wantErr {
+					if err == nil {
+						t.Fatalf("picked %s, want an error", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.only {
+					t.Fatalf("height %d picked %s, want %s", height, got, tt.only)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectProposerFollowsStake(t *testing.T) {
+	stakes := map[string]int64{"alice": 100, "bob": 300, "carol": 600}
+	const draws = 10000
+	picks := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		addr, err := selectProposer(stakes, fmt.Sprintf("block %d", i), i, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[addr]++
+	}
+	for addr, stake := range stakes {
+		share := float64(picks[addr]) / draws
+		want := float64(stake) / 1000
+		if share < want-0.03 || share > want+0.03 {
+			t.Errorf("%s picked %.3f of the time, want about %.3f", addr, share, want)
+		}
+	}
+}
+
+// signedHeader returns a signed header on parent that differs by nonce.
+func signedHeader(t *testing.T, key *ecdsa.PrivateKey, parent string, nonce int) BlockHeaderData {
+	t.Helper()
+	signer, err := addressFromKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := Block{
+		Version:    BlockHeaderVersion,
+		PrevHash:   parent,
+		MerkleRoot: calculateSHA256(""),
+		TimeStamp:  1000,
+		Bits:       1,
+		Nonce:      nonce,
+		Signer:     signer,
+	}
+	block.Hash = block.calculateHash()
+	if block.Signature, err = signHash(key, block.Hash); err != nil {
+		t.Fatal(err)
+	}
+	return blockToHeaderData(block)
+}
+
+func TestDoubleSignEvidenceVerify(t *testing.T) {
+	key, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offender, _ := addressFromKey(&key.PublicKey)
+	parent := calculateSHA256("parent")
+	first := signedHeader(t, key, parent, 0)
+	second := signedHeader(t, key, parent, 1)
+
+	tampered := second
+	tampered.Nonce = 2
+	forged := second
+	forged.Signature = signedHeader(t, other, parent, 1).Signature
+	unsigned := second
+	unsigned.Signature = nil
+
+	tests := []struct {
+		name    string
+		ev      DoubleSignEvidence
+		wantErr string
+	}{
+		{name: "two blocks on one parent", ev: DoubleSignEvidence{First: first, Second: second}},
+		{name: "same block twice", ev: DoubleSignEvidence{First: first, Second: first}, wantErr: "same block"},
+		{name: "different parents", ev: DoubleSignEvidence{First: first, Second: signedHeader(t, key, calculateSHA256("other"), 1)}, wantErr: "same height"},
+		{name: "different signers", ev: DoubleSignEvidence{First: first, Second: signedHeader(t, other, parent, 1)}, wantErr: "different signers"},
+		{name: "header altered after signing", ev: DoubleSignEvidence{First: first, Second: tampered}, wantErr: "does not match its hash"},
+		{name: "signature by someone else", ev: DoubleSignEvidence{First: first, Second: forged}, wantErr: "evidence header"},
+		{name: "unsigned header", ev: DoubleSignEvidence{First: first, Second: unsigned}, wantErr: "not signed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.ev.verify()
+			checkErr(t, err, tt.wantErr)
+			if tt.wantErr == "" && got != offender {
+				t.Fatalf("offender is %s, want %s", got, offender)
+			}
+		})
+	}
+}
+
+func TestProofOfStakeVerifySealRounds(t *testing.T) {
+	small, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallAddr, _ := addressFromKey(&small.PublicKey)
+	largeAddr, _ := addressFromKey(&large.PublicKey)
+
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	bc.SetEngine(&ProofOfStake{})
+	bc.GenesisStakes = map[string]int64{smallAddr: 1, largeAddr: 99}
+	stakes := map[string]int64{smallAddr: 1, largeAddr: 99}
+	prev := bc.Chain[0]
+
+	// firstRound returns the first round from start proposed by the small
+	// validator.
+	firstRound := func(start int) int {
+		for round := start; ; round++ {
+			if p, _ := selectProposer(stakes, prev.Hash, 1, round); p == smallAddr {
+				return round
+			}
+		}
+	}
+	inRange := firstRound(0)
+	if inRange >= posMaxRounds {
+		t.Skipf("the small validator has no round below %d", posMaxRounds)
+	}
+
+	tests := []struct {
+		name    string
+		round   int
+		wantErr string
+	}{
+		{name: "its round", round: inRange},
+		{name: "past the last round", round: firstRound(posMaxRounds), wantErr: "invalid round"},
+		// prev.TimeStamp + round*posRoundTime wraps around int64.
+		{name: "round that overflows the opening time", round: firstRound(4611686018427387904), wantErr: "invalid round"},
+		{name: "negative round", round: -1, wantErr: "invalid round"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := NewBlock(prev.TimeStamp+int64(inRange)*posRoundTime, map[string]interface{}{"transactions": []Transaction{}})
+			block.PrevHash = prev.Hash
+			block.Bits = 1
+			block.Nonce = tt.round
+			block.Signer = smallAddr
+			block.Hash = block.calculateHash()
+			if block.Signature, err = signHash(small, block.Hash); err != nil {
+				t.Fatal(err)
+			}
+			bc.Chain = []Block{prev, block}
+			checkErr(t, bc.Engine().VerifySeal(bc, 1), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+)
+
+// powLimitBits is the easiest allowed target, roughly one leading zero hex
+// digit. Difficulty is reported relative to it, so a block at powLimitBits
+// has difficulty 1.
+const powLimitBits = 0x200fffff
+
+var (
+	powLimit = compactToTarget(powLimitBits)
+	twoTo256 = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// compactToTarget expands Bitcoin's compact "bits" encoding: the high byte is
+// the target's length in bytes and the low three bytes are its leading digits.
+func compactToTarget(bits uint32) *big.Int {
+	exponent := uint(bits >> 24)
+	mantissa := int64(bits & 0x007fffff)
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		return target.Rsh(target, 8*(3-exponent))
+	}
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// targetToCompact is the inverse of compactToTarget. Precision beyond the
+// three mantissa bytes is dropped, rounding the target down.
+func targetToCompact(target *big.Int) uint32 {
+	size := uint((target.BitLen() + 7) / 8)
+	var mantissa uint32
+	if size <= 3 {
+		mantissa = uint32(target.Int64()) << (8 * (3 - size))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, 8*(size-3)).Int64())
+	}
+	// The mantissa's top bit is a sign bit; move a byte into the exponent
+	// rather than produce a negative target.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+	return uint32(size)<<24 | mantissa
+}
+
+// difficultyToBits returns the compact target for a hash with the given
+// number of leading zero hex digits.
+func difficultyToBits(zeros int) uint32 {
+	target := new(big.Int).Rsh(twoTo256, uint(4*zeros))
+	return targetToCompact(target.Sub(target, big.NewInt(1)))
+}
+
+// hashMeetsTarget reports whether a hex block hash, read as a 256-bit
+// number, is at or below the target encoded by bits.
+func hashMeetsTarget(hash string, bits uint32) bool {
+	value, ok := new(big.Int).SetString(hash, 16)
+	if !ok {
+		return false
+	}
+	return value.Cmp(compactToTarget(bits)) <= 0
+}
+
+// blockWork is the expected number of hashes needed to meet a target:
+// 2^256 / (target + 1).
+func blockWork(bits uint32) *big.Int {
+	target := compactToTarget(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Div(twoTo256, target.Add(target, big.NewInt(1)))
+}
+
+// bitsDifficulty reports how many times harder a target is than powLimit.
+func bitsDifficulty(bits uint32) float64 {
+	target := compactToTarget(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	ratio, _ := new(big.Rat).SetFrac(powLimit, target).Float64()
+	return ratio
+}
+
+func formatBits(bits uint32) string {
+	return fmt.Sprintf("0x%08x", bits)
+}
+
+// ChainWork returns the cumulative work of the chain up to and including
+// the block at height. The genesis block is not mined and adds no work.
+func (bc *Blockchain) ChainWork(height int) *big.Int {
+	work := new(big.Int)
+	for i := 1; i <= height && i < len(bc.Chain); i++ {
+		work.Add(work, bc.Engine().BlockWork(bc.Chain[i].Bits))
+	}
+	return work
+}
+
+// TotalWork returns the cumulative work of the whole chain. When two valid
+// chains compete, the one with more total work is preferred.
+func (bc *Blockchain) TotalWork() *big.Int {
+	return bc.ChainWork(len(bc.Chain) - 1)
+}
+
+// ProofOfWork is the default consensus engine: a block is valid if its hash
+// is at or below the target required at its height. Miner controls how the
+// nonce search runs; a nil Miner uses one thread per CPU.
+type ProofOfWork struct {
+	Miner *Miner
+}
+
+func (e *ProofOfWork) Name() string {
+	return ConsensusPoW
+}
+
+func (e *ProofOfWork) Difficulty(bc *Blockchain, height int) uint32 {
+	return bc.bitsAt(height)
+}
+
+func (e *ProofOfWork) Seal(ctx context.Context, bc *Blockchain, block *Block) error {
+	miner := e.Miner
+	if miner == nil {
+		miner = NewMiner(0)
+	}
+	_, err := miner.Mine(ctx, block)
+	return err
+}
+
+// VerifySeal checks that a block records the target required at its height
+// and that its hash, read as a number, does not exceed it.
+func (e *ProofOfWork) VerifySeal(bc *Blockchain, height int) error {
+	block := bc.Chain[height]
+	if want := bc.bitsAt(height); block.Bits != want {
+		return fmt.Errorf("bits %s do not match required bits %s", formatBits(block.Bits), formatBits(want))
+	}
+	if !hashMeetsTarget(block.Hash, block.Bits) {
+		return fmt.Errorf("hash is above target %s", formatBits(block.Bits))
+	}
+	return nil
+}
+
+func (e *ProofOfWork) BlockWork(bits uint32) *big.Int {
+	return blockWork(bits)
+}
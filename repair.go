@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LoadError says where a chain failed to load.
+type LoadError struct {
+	File   string
+	Offset int64 // byte offset in File, or -1 if unknown
+	Block  int   // height of the block being read, or -1
+	Err    error
+}
+
+func (e *LoadError) Error() string {
+	msg := e.File
+	if e.Block >= 0 {
+		msg += fmt.Sprintf(", block %d", e.Block)
+	}
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(", byte %d", e.Offset)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// fileLoadError wraps an error reading or decoding the file at path. An
+// error that already says which block failed only gets the file filled in.
+func fileLoadError(path string, err error) error {
+	var loadErr *LoadError
+	if errors.As(err, &loadErr) {
+		if loadErr.File == "" {
+			loadErr.File = path
+		}
+		return loadErr
+	}
+	offset := int64(-1)
+	if at, ok := jsonErrorOffset(err); ok {
+		offset = at
+	}
+	return &LoadError{File: path, Offset: offset, Block: -1, Err: err}
+}
+
+// jsonErrorOffset returns the input offset recorded in a JSON decoding
+// error, if it has one.
+func jsonErrorOffset(err error) (int64, bool) {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return syntaxErr.Offset, true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Offset, true
+	}
+	return 0, false
+}
+
+// RepairReport describes what recoverChainStore salvaged.
+type RepairReport struct {
+	Read           int   // blocks decoded from the log
+	Recovered      int   // blocks kept: the longest valid prefix
+	Problem        error // why the rest was dropped, nil if nothing was
+	PendingKept    int
+	PendingDropped int
+}
+
+// recoverChainStore rebuilds as much of the chain in the block store in dir
+// as it can. The index is ignored: blocks are read straight from the log
+// until one fails to decode, and then cut back to the longest prefix that
+// passes validation. Pending transactions are kept if they still apply.
+func recoverChainStore(dir string) (*Blockchain, RepairReport, error) {
+	var report RepairReport
+	metaPath := filepath.Join(dir, chainMetaFile)
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, report, fileLoadError(metaPath, err)
+	}
+	var meta ChainMetaData
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, report, fileLoadError(metaPath, err)
+	}
+	bc, err := blockchainFromParams(meta.ChainParamsData)
+	if err != nil {
+		return nil, report, fileLoadError(metaPath, err)
+	}
+
+	logPath := filepath.Join(dir, blockLogFile)
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, report, fileLoadError(logPath, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			// A last line with no newline was cut off mid-write.
+			report.Problem = &LoadError{File: logPath, Offset: offset, Block: len(bc.Chain), Err: fmt.Errorf("incomplete block")}
+			break
+		}
+		block, err := decodeBlockLine(logPath, line, offset, len(bc.Chain))
+		if err != nil {
+			report.Problem = err
+			break
+		}
+		bc.Chain = append(bc.Chain, block)
+		if bc.usesUTXO() {
+			bc.applyBlockToUTXOSet(block)
+		}
+		offset += int64(len(line))
+	}
+	report.Read = len(bc.Chain)
+	if len(bc.Chain) == 0 {
+		return nil, report, fmt.Errorf("no readable blocks in %s: %v", logPath, report.Problem)
+	}
+
+	valid, err := bc.validPrefix()
+	if valid == 0 {
+		return nil, report, fmt.Errorf("the genesis block is invalid: %v", err)
+	}
+	if valid < len(bc.Chain) {
+		report.Problem = err
+		bc.Chain = bc.Chain[:valid]
+		if bc.usesUTXO() {
+			if err := bc.RebuildUTXOSet(); err != nil {
+				return nil, report, err
+			}
+		}
+	}
+	report.Recovered = len(bc.Chain)
+
+	data, err = os.ReadFile(filepath.Join(dir, pendingFile))
+	if err == nil {
+		var pending []TransactionData
+		if decodeJSONNumbers(data, &pending) == nil {
+			for _, tx := range dataToTransactions(pending) {
+				if bc.AddTransaction(tx) == nil {
+					report.PendingKept++
+				} else {
+					report.PendingDropped++
+				}
+			}
+		}
+	}
+	return bc, report, nil
+}
+
+// quarantineChainStore moves the block store in dir aside so a repaired one
+// can take its place. It returns the new location.
+func quarantineChainStore(dir string) (string, error) {
+	dest := fmt.Sprintf("%s.corrupt-%s", dir, time.Now().Format("20060102-150405"))
+	if err := os.Rename(dir, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
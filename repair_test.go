@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecoverChainStoreKeepsValidPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(line string) string
+		// wantLoadErr is set if loading fails on the damaged line itself
+		// rather than the chain failing validation.
+		wantLoadErr bool
+		wantRead    int
+		wantProblem string
+	}{
+		{
+			name:        "unreadable block",
+			corrupt:     func(line string) string { return "x" + line[1:] },
+			wantLoadErr: true,
+			wantRead:    2,
+			wantProblem: "block 2",
+		},
+		{
+			name: "altered reward",
+			corrupt: func(line string) string {
+				return strings.Replace(line, `"amount":50000000,`, `"amount":50000001,`, 1)
+			},
+			wantRead:    4,
+			wantProblem: "block 2: merkle root",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			alice, aliceAddr := testKey(t)
+			bob, bobAddr := testKey(t)
+			bc := NewBlockchain(1, 50*UnitsPerCoin)
+			for _, miner := range []string{aliceAddr, bobAddr, "miner"} {
+				if _, err := bc.MinePendingTransactions(context.Background(), miner); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Alice's coins come from block 1, which survives; Bob's from
+			// block 2, which does not.
+			for _, from := range []struct {
+				key  *ecdsa.PrivateKey
+				addr string
+			}{{alice, aliceAddr}, {bob, bobAddr}} {
+				tx := NewTransaction(from.addr, "carol", UnitsPerCoin)
+				tx.Nonce = bc.GetNextNonce(from.addr)
+				tx.signTransaction(from.key)
+				if err := bc.AddTransaction(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := saveChainStore(dir, bc); err != nil {
+				t.Fatal(err)
+			}
+
+			logPath := filepath.Join(dir, blockLogFile)
+			data, err := os.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitAfter(string(data), "\n")
+			start := int64(len(lines[0]) + len(lines[1]))
+			damaged := tt.corrupt(lines[2])
+			if damaged == lines[2] || len(damaged) != len(lines[2]) {
+				t.Fatalf("corrupting block 2 changed %d bytes to %d", len(lines[2]), len(damaged))
+			}
+			lines[2] = damaged
+			if err := os.WriteFile(logPath, []byte(strings.Join(lines, "")), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := loadChainStore(dir)
+			if tt.wantLoadErr {
+				var loadErr *LoadError
+				if !errors.As(err, &loadErr) {
+					t.Fatalf("loading the damaged chain: got %v, want a LoadError", err)
+				}
+				if loadErr.File != logPath || loadErr.Block != 2 || loadErr.Offset < start || loadErr.Offset >= start+int64(len(damaged)) {
+					t.Fatalf("load error points at %s, block %d, byte %d; want %s, block 2, bytes %d to %d",
+						loadErr.File, loadErr.Block, loadErr.Offset, logPath, start, start+int64(len(damaged)))
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkErr(t, loaded.ValidateChain(), tt.wantProblem)
+			}
+
+			repaired, report, err := recoverChainStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Read != tt.wantRead {
+				t.Errorf("read %d blocks, want %d", report.Read, tt.wantRead)
+			}
+			if report.Recovered != 2 || len(repaired.Chain) != 2 {
+				t.Fatalf("kept %d blocks (report says %d), want 2", len(repaired.Chain), report.Recovered)
+			}
+			for i, block := range repaired.Chain {
+				if block.Hash != bc.Chain[i].Hash {
+					t.Errorf("block %d has hash %s, want %s", i, block.Hash, bc.Chain[i].Hash)
+				}
+			}
+			checkErr(t, report.Problem, tt.wantProblem)
+			if err := repaired.ValidateChain(); err != nil {
+				t.Fatalf("repaired chain does not validate: %v", err)
+			}
+
+			// Alice's transfer still applies, Bob's no longer does.
+			if report.PendingKept != 1 || report.PendingDropped != 1 {
+				t.Fatalf("pending kept %d, dropped %d; want 1 and 1", report.PendingKept, report.PendingDropped)
+			}
+			if len(repaired.PendingTransactions) != 1 || repaired.PendingTransactions[0].FromAddress != aliceAddr {
+				t.Fatalf("pending after repair = %+v, want Alice's transfer", repaired.PendingTransactions)
+			}
+		})
+	}
+}
+
+func testKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := addressFromKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, addr
+}
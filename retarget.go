@@ -0,0 +1,92 @@
+package main
+
+import "math/big"
+
+// Retargeting schemes. With RetargetNone every block uses the chain's fixed
+// difficulty. RetargetMovingAverage adjusts every block from the average
+// spacing and target of the last RetargetWindow blocks. RetargetEpoch, like
+// Bitcoin, only adjusts once every RetargetWindow blocks.
+const (
+	RetargetNone          = ""
+	RetargetMovingAverage = "moving-average"
+	RetargetEpoch         = "epoch"
+)
+
+// maxRetargetFactor bounds how far a single adjustment can move the target,
+// so a handful of odd timestamps cannot swing the difficulty wildly.
+const maxRetargetFactor = 4
+
+func validRetargetMode(mode string) bool {
+	return mode == RetargetNone || mode == RetargetMovingAverage || mode == RetargetEpoch
+}
+
+// NextBits returns the Bits value the next block must carry, as chosen by
+// the consensus engine.
+func (bc *Blockchain) NextBits() uint32 {
+	return bc.Engine().Difficulty(bc, len(bc.Chain))
+}
+
+// bitsAt returns the compact target required for the block at the given
+// height, using only the blocks before it.
+func (bc *Blockchain) bitsAt(height int) uint32 {
+	initial := difficultyToBits(bc.Difficulty)
+	prev := initial
+	if height > 1 {
+		prev = bc.Chain[height-1].Bits
+	}
+
+	switch bc.RetargetMode {
+	case RetargetMovingAverage:
+		// Genesis is skipped: its timestamp says when the chain was created,
+		// not when it was mined.
+		first := height - bc.RetargetWindow
+		if first < 1 {
+			first = 1
+		}
+		last := height - 1
+		if last-first < 1 {
+			return prev
+		}
+		// Like Dark Gravity Wave, start from the average target the window's
+		// blocks were mined at rather than from prev. Scaling prev would
+		// compound: a slow spell would raise the target again for every block
+		// it stays in the window.
+		sum := new(big.Int)
+		for h := first + 1; h <= last; h++ {
+			sum.Add(sum, compactToTarget(bc.Chain[h].Bits))
+		}
+		average := sum.Div(sum, big.NewInt(int64(last-first)))
+		return retarget(targetToCompact(average), bc.Chain[last].TimeStamp-bc.Chain[first].TimeStamp, int64(last-first)*bc.TargetBlockTime)
+
+	case RetargetEpoch:
+		if bc.RetargetWindow < 2 || (height-1)%bc.RetargetWindow != 0 || height-1 < bc.RetargetWindow {
+			return prev
+		}
+		first, last := height-bc.RetargetWindow, height-1
+		return retarget(prev, bc.Chain[last].TimeStamp-bc.Chain[first].TimeStamp, int64(last-first)*bc.TargetBlockTime)
+	}
+	return initial
+}
+
+// retarget scales the target by actual/expected time: blocks that came too
+// fast shrink the target (harder), slow blocks grow it (easier). The factor
+// is clamped to maxRetargetFactor and the target never exceeds powLimit.
+func retarget(bits uint32, actual, expected int64) uint32 {
+	if actual < expected/maxRetargetFactor {
+		actual = expected / maxRetargetFactor
+	}
+	if actual > expected*maxRetargetFactor {
+		actual = expected * maxRetargetFactor
+	}
+	if actual < 1 {
+		actual = 1
+	}
+
+	target := compactToTarget(bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+	return targetToCompact(target)
+}
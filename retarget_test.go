@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// retargetChain builds a chain whose blocks arrive after the given intervals,
+// each carrying the bits bitsAt requires of it.
+func retargetChain(mode string, window int, intervals []int64) *Blockchain {
+	bc := &Blockchain{Difficulty: 4, RetargetMode: mode, TargetBlockTime: 10, RetargetWindow: window}
+	bc.Chain = []Block{{TimeStamp: 1000}}
+	for _, interval := range intervals {
+		height := len(bc.Chain)
+		bc.Chain = append(bc.Chain, Block{
+			TimeStamp: bc.Chain[height-1].TimeStamp + interval,
+			Bits:      bc.bitsAt(height),
+		})
+	}
+	return bc
+}
+
+func repeatInterval(interval int64, n int) []int64 {
+	intervals := make([]int64, n)
+	for i := range intervals {
+		intervals[i] = interval
+	}
+	return intervals
+}
+
+// targetRatio returns the target of bits relative to the chain's initial
+// target.
+func targetRatio(bc *Blockchain, bits uint32) float64 {
+	ratio, _ := new(big.Rat).SetFrac(compactToTarget(bits), compactToTarget(difficultyToBits(bc.Difficulty))).Float64()
+	return ratio
+}
+
+func TestBitsAt(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		window    int
+		intervals []int64
+		want      float64 // next target relative to the initial one
+	}{
+		{name: "fixed difficulty ignores spacing", mode: RetargetNone, window: 5, intervals: repeatInterval(1, 12), want: 1},
+		{name: "moving average on target", mode: RetargetMovingAverage, window: 5, intervals: repeatInterval(10, 12), want: 1},
+		{name: "moving average twice as fast", mode: RetargetMovingAverage, window: 5, intervals: repeatInterval(5, 2), want: 0.5},
+		{name: "moving average clamps to a factor of 4", mode: RetargetMovingAverage, window: 5, intervals: repeatInterval(1000, 2), want: 4},
+		{name: "epoch on target", mode: RetargetEpoch, window: 5, intervals: repeatInterval(10, 10), want: 1},
+		{name: "epoch waits for the boundary", mode: RetargetEpoch, window: 5, intervals: repeatInterval(5, 4), want: 1},
+		{name: "epoch twice as fast", mode: RetargetEpoch, window: 5, intervals: repeatInterval(5, 5), want: 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := retargetChain(tt.mode, tt.window, tt.intervals)
+			got := targetRatio(bc, bc.NextBits())
+			if got < tt.want*0.999 || got > tt.want*1.001 {
+				t.Fatalf("next target is %.4f times the initial one, want %.4f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovingAverageSlowWindowDoesNotCompound(t *testing.T) {
+	const window, slow = 5, 11
+	bc := &Blockchain{Difficulty: 4, RetargetMode: RetargetMovingAverage, TargetBlockTime: 10, RetargetWindow: window}
+	bc.Chain = []Block{{TimeStamp: 1000}}
+
+	// Miners with constant hash power take 10 seconds a block at the initial
+	// target and proportionally less at an easier one. Block 11 is slow.
+	highest := 0.0
+	for height := 1; height <= slow+4*window; height++ {
+		bits := bc.bitsAt(height)
+		ratio := targetRatio(bc, bits)
+		if ratio > highest {
+			highest = ratio
+		}
+		interval := int64(10/ratio + 0.5)
+		if height == slow {
+			interval = 50
+		}
+		bc.Chain = append(bc.Chain, Block{TimeStamp: bc.Chain[height-1].TimeStamp + interval, Bits: bits})
+	}
+
+	// Scaling the previous target by each window's spacing raises it again
+	// for every block the slow one stays in the window, and the miners never
+	// win all of it back.
+	if highest > maxRetargetFactor {
+		t.Errorf("target rose to %.2f times the initial one", highest)
+	}
+	if got := targetRatio(bc, bc.NextBits()); got < 0.95 || got > 1.05 {
+		t.Errorf("target settled at %.3f times the initial one, want about 1", got)
+	}
+}
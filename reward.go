@@ -0,0 +1,108 @@
+package main
+
+import "fmt"
+
+// BlockSubsidy returns the newly created coins the block at height may pay
+// to its miner, on top of the fees it collects. The subsidy starts at
+// MiningReward, halves every HalvingInterval blocks and stops once MaxSupply
+// coins have been issued. A zero HalvingInterval or MaxSupply disables that
+// rule. The genesis block has no subsidy.
+func (bc *Blockchain) BlockSubsidy(height int) int64 {
+	if height <= 0 {
+		return 0
+	}
+	return bc.IssuedSupply(height) - bc.IssuedSupply(height-1)
+}
+
+// IssuedSupply returns the total subsidy scheduled for blocks 1..height,
+// capped so that together with the genesis allocations no more than
+// MaxSupply coins exist. Each halving era is summed in one step.
+func (bc *Blockchain) IssuedSupply(height int) int64 {
+	limit := bc.MaxSupply
+	if limit > 0 {
+		limit -= bc.Premine()
+		if limit <= 0 {
+			return 0
+		}
+	}
+	var total int64
+	for era := 0; ; era++ {
+		reward := bc.eraSubsidy(era)
+		if reward == 0 {
+			break
+		}
+		first, last := 1, height
+		if bc.HalvingInterval > 0 {
+			first = max(1, era*bc.HalvingInterval)
+			last = min(height, (era+1)*bc.HalvingInterval-1)
+		}
+		if first > last {
+			break
+		}
+		total += int64(last-first+1) * reward
+		if limit > 0 && total >= limit {
+			return limit
+		}
+		if bc.HalvingInterval <= 0 {
+			break
+		}
+	}
+	return total
+}
+
+// eraSubsidy returns the per-block subsidy during the given halving era.
+func (bc *Blockchain) eraSubsidy(era int) int64 {
+	if era >= 63 {
+		return 0
+	}
+	return bc.MiningReward >> era
+}
+
+// isCoinbase reports whether tx is a mining reward, which has no sender.
+func isCoinbase(tx Transaction) bool {
+	return tx.FromAddress == ""
+}
+
+// coinbaseValue returns how much a mining reward pays out. UTXO coinbases pay
+// through their outputs.
+func (bc *Blockchain) coinbaseValue(tx Transaction) int64 {
+	if bc.usesUTXO() {
+		return tx.OutputTotal()
+	}
+	return tx.Amount
+}
+
+// checkCoinbase verifies that a block has at most one mining reward, that it
+// comes first and that it pays no more than the subsidy plus the block's fees.
+func (bc *Blockchain) checkCoinbase(height int, b Block) error {
+	txs := b.Transactions()
+	var fees int64
+	coinbases := 0
+	for _, tx := range txs {
+		if isCoinbase(tx) {
+			coinbases++
+		} else {
+			fees += tx.Fee
+		}
+	}
+	if coinbases == 0 {
+		return nil
+	}
+	if coinbases > 1 {
+		return fmt.Errorf("block has %d coinbase transactions", coinbases)
+	}
+	if !isCoinbase(txs[0]) {
+		return fmt.Errorf("coinbase must be the first transaction")
+	}
+
+	value := bc.coinbaseValue(txs[0])
+	subsidy := bc.BlockSubsidy(height)
+	if value < 0 {
+		return fmt.Errorf("coinbase pays a negative amount")
+	}
+	if value > subsidy+fees {
+		return fmt.Errorf("coinbase pays %s, more than the %s subsidy plus %s in fees",
+			FormatAmount(value), FormatAmount(subsidy), FormatAmount(fees))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func rewardChain(reward int64, halving int, maxSupply, premine int64) *Blockchain {
+	genesis := Block{Data: map[string]interface{}{"transactions": []Transaction{}}}
+	if premine > 0 {
+		genesis.Data["transactions"] = []Transaction{NewTransaction("", "alice", premine)}
+	}
+	return &Blockchain{Chain: []Block{genesis}, MiningReward: reward, HalvingInterval: halving, MaxSupply: maxSupply}
+}
+
+func TestBlockSubsidy(t *testing.T) {
+	tests := []struct {
+		name   string
+		bc     *Blockchain
+		height int
+		want   int64
+	}{
+		{name: "genesis has none", bc: rewardChain(50, 0, 0, 0), height: 0, want: 0},
+		{name: "constant without halving", bc: rewardChain(50, 0, 0, 0), height: 1_000_000, want: 50},
+		{name: "first era", bc: rewardChain(64, 10, 0, 0), height: 9, want: 64},
+		{name: "first halving", bc: rewardChain(64, 10, 0, 0), height: 10, want: 32},
+		{name: "second halving", bc: rewardChain(64, 10, 0, 0), height: 20, want: 16},
+		{name: "halved to nothing", bc: rewardChain(64, 10, 0, 0), height: 70, want: 0},
+		{name: "below the cap", bc: rewardChain(100, 0, 250, 0), height: 2, want: 100},
+		{name: "last block is cut to the cap", bc: rewardChain(100, 0, 250, 0), height: 3, want: 50},
+		{name: "after the cap", bc: rewardChain(100, 0, 250, 0), height: 4, want: 0},
+		{name: "premine counts towards the cap", bc: rewardChain(100, 0, 450, 200), height: 3, want: 50},
+		{name: "premine above the cap", bc: rewardChain(100, 0, 100, 200), height: 1, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.bc.BlockSubsidy(tt.height); got != tt.want {
+				t.Fatalf("BlockSubsidy(%d) = %d, want %d", tt.height, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssuedSupplyMatchesSubsidies(t *testing.T) {
+	tests := []struct {
+		name string
+		bc   *Blockchain
+		want int64 // total ever issued
+	}{
+		// 9 blocks of 64, then 10 each of 32, 16, 8, 4, 2 and 1.
+		{name: "halving", bc: rewardChain(64, 10, 0, 0), want: 9*64 + 10*(32+16+8+4+2+1)},
+		{name: "cap", bc: rewardChain(100, 0, 250, 0), want: 250},
+		{name: "halving and cap", bc: rewardChain(64, 10, 1000, 0), want: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sum int64
+			for height := 1; height <= 200; height++ {
+				sum += tt.bc.BlockSubsidy(height)
+				if issued := tt.bc.IssuedSupply(height); issued != sum {
+					t.Fatalf("IssuedSupply(%d) = %d, but subsidies add up to %d", height, issued, sum)
+				}
+			}
+			if sum != tt.want {
+				t.Fatalf("issued %d in total, want %d", sum, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import "fmt"
+
+// chainState is the ledger view produced by replaying transactions in
+// order. It is used to check that every sender can cover what they spend.
+// Account chains track balances directly; UTXO chains track the set of
+// unspent outputs, with each address's total kept alongside. Both track the
+// next nonce expected from each sender so a signed transaction can only be
+// included once. Proof-of-stake chains also track each validator's locked
+// stake and the double-signs that have already been slashed.
+type chainState struct {
+	utxo     bool
+	balances map[string]int64
+	utxos    map[string]TxOutput
+	nonces   map[string]uint64
+	stakes   map[string]int64
+	slashed  map[string]bool
+}
+
+func newChainState(model string) *chainState {
+	return &chainState{
+		utxo:     model == ModelUTXO,
+		balances: make(map[string]int64),
+		utxos:    make(map[string]TxOutput),
+		nonces:   make(map[string]uint64),
+		stakes:   make(map[string]int64),
+		slashed:  make(map[string]bool),
+	}
+}
+
+// initialState returns the ledger state before block 1, holding the stakes
+// the chain was created with.
+func (bc *Blockchain) initialState() *chainState {
+	s := newChainState(bc.Model)
+	for addr, stake := range bc.GenesisStakes {
+		s.stakes[addr] = stake
+	}
+	return s
+}
+
+// clone returns a copy of the state that can be changed independently.
+func (s *chainState) clone() *chainState {
+	c := &chainState{
+		utxo:     s.utxo,
+		balances: make(map[string]int64, len(s.balances)),
+		utxos:    make(map[string]TxOutput, len(s.utxos)),
+		nonces:   make(map[string]uint64, len(s.nonces)),
+		stakes:   make(map[string]int64, len(s.stakes)),
+		slashed:  make(map[string]bool, len(s.slashed)),
+	}
+	for k, v := range s.balances {
+		c.balances[k] = v
+	}
+	for k, v := range s.utxos {
+		c.utxos[k] = v
+	}
+	for k, v := range s.nonces {
+		c.nonces[k] = v
+	}
+	for k, v := range s.stakes {
+		c.stakes[k] = v
+	}
+	for k, v := range s.slashed {
+		c.slashed[k] = v
+	}
+	return c
+}
+
+// tipState gives the state the next block is applied to. It comes from the
+// state index when that is up to date, and from replaying the whole chain
+// otherwise.
+func (bc *Blockchain) tipState() (*chainState, error) {
+	if bc.updateStateIndex() == nil {
+		return bc.index.state.clone(), nil
+	}
+	return bc.replayState()
+}
+
+// replayState replays the whole chain, giving the state the next block is
+// applied to.
+func (bc *Blockchain) replayState() (*chainState, error) {
+	state := bc.initialState()
+	for i := 0; i < len(bc.Chain); i++ {
+		for _, tx := range bc.Chain[i].Transactions() {
+			if err := state.applyTransaction(tx); err != nil {
+				return nil, fmt.Errorf("block %d: %v", i, err)
+			}
+		}
+	}
+	return state, nil
+}
+
+// pendingState is tipState followed by the pending pool, giving the state a
+// new transaction will be applied on top of.
+func (bc *Blockchain) pendingState() (*chainState, error) {
+	state, err := bc.tipState()
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range bc.PendingTransactions {
+		if err := state.applyTransaction(tx); err != nil {
+			return nil, fmt.Errorf("pending transaction %s: %v", tx.ID(), err)
+		}
+	}
+	return state, nil
+}
+
+// applyTransaction moves funds for a single transaction, rejecting it if the
+// sender's balance cannot cover the amount. Mining rewards have no sender
+// and only credit the recipient.
+func (s *chainState) applyTransaction(tx Transaction) error {
+	if tx.FromAddress != "" {
+		if err := checkNonce(tx, s.nonces[tx.FromAddress]); err != nil {
+			return err
+		}
+	}
+
+	if tx.Type != "" {
+		if err := checkTypedTransaction(tx); err != nil {
+			return err
+		}
+		if err := s.applyStakeTransaction(tx); err != nil {
+			return err
+		}
+		s.advanceNonce(tx)
+		return nil
+	}
+
+	if s.utxo {
+		if err := s.applyUTXOTransaction(tx); err != nil {
+			return err
+		}
+		s.advanceNonce(tx)
+		return nil
+	}
+
+	if len(tx.Inputs) > 0 || len(tx.Outputs) > 0 {
+		return fmt.Errorf("account chains do not accept transactions with inputs or outputs")
+	}
+	if tx.FromAddress != "" {
+		if tx.Amount <= 0 {
+			return fmt.Errorf("transaction amount must be positive")
+		}
+		if tx.Fee < 0 {
+			return fmt.Errorf("transaction fee must not be negative")
+		}
+		available := s.balances[tx.FromAddress]
+		if tx.Amount+tx.Fee > available {
+			return fmt.Errorf("insufficient balance for %s: %s available, %s requested",
+				formatAddress(tx.FromAddress), FormatAmount(available), FormatAmount(tx.Amount+tx.Fee))
+		}
+		s.balances[tx.FromAddress] -= tx.Amount + tx.Fee
+	}
+	s.balances[tx.ToAddress] += tx.Amount
+	s.advanceNonce(tx)
+	return nil
+}
+
+func (s *chainState) advanceNonce(tx Transaction) {
+	if tx.FromAddress != "" {
+		s.nonces[tx.FromAddress]++
+	}
+}
+
+// checkNonce rejects a transaction unless it carries exactly the next
+// sequence number for its sender.
+func checkNonce(tx Transaction, expected uint64) error {
+	switch {
+	case tx.Nonce < expected:
+		return fmt.Errorf("nonce %d already used by %s (next is %d)", tx.Nonce, formatAddress(tx.FromAddress), expected)
+	case tx.Nonce > expected:
+		return fmt.Errorf("nonce %d out of order for %s (next is %d)", tx.Nonce, formatAddress(tx.FromAddress), expected)
+	}
+	return nil
+}
+
+// checkTypedTransaction checks the shape of a transaction that carries a type
+// instead of moving coins. Whether the type is allowed on the chain is up to
+// the consensus engine.
+func checkTypedTransaction(tx Transaction) error {
+	switch tx.Type {
+	case TxTypeVote:
+		if tx.FromAddress == "" {
+			return fmt.Errorf("votes must be signed by their voter")
+		}
+		if tx.Amount != 0 || tx.Fee != 0 || len(tx.Inputs) > 0 || len(tx.Outputs) > 0 {
+			return fmt.Errorf("votes cannot move coins")
+		}
+		if tx.Payload != VoteAdd && tx.Payload != VoteRemove {
+			return fmt.Errorf("vote must be %q or %q, got %q", VoteAdd, VoteRemove, tx.Payload)
+		}
+		return nil
+
+	case TxTypeStake, TxTypeUnstake:
+		if tx.FromAddress == "" || tx.ToAddress != tx.FromAddress {
+			return fmt.Errorf("%s transactions must be sent from and to the validator", tx.Type)
+		}
+		if tx.Amount <= 0 {
+			return fmt.Errorf("%s amount must be positive", tx.Type)
+		}
+		if tx.Fee < 0 {
+			return fmt.Errorf("transaction fee must not be negative")
+		}
+		if len(tx.Inputs) > 0 || len(tx.Outputs) > 0 || tx.Payload != "" {
+			return fmt.Errorf("%s transactions carry no inputs, outputs or payload", tx.Type)
+		}
+		return nil
+
+	case TxTypeEvidence:
+		if tx.FromAddress == "" {
+			return fmt.Errorf("evidence must be signed by its reporter")
+		}
+		if tx.Amount != 0 || len(tx.Inputs) > 0 || len(tx.Outputs) > 0 {
+			return fmt.Errorf("evidence cannot move coins")
+		}
+		if tx.Fee < 0 {
+			return fmt.Errorf("transaction fee must not be negative")
+		}
+		_, offender, err := parseEvidence(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if tx.ToAddress != offender {
+			return fmt.Errorf("evidence is addressed to %s but was signed by %s", formatAddress(tx.ToAddress), formatAddress(offender))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transaction type %q", tx.Type)
+}
+
+// applyStakeTransaction moves coins between a validator's balance and its
+// stake, or burns the stake of a validator caught double-signing. Other
+// typed transactions only pay their fee.
+func (s *chainState) applyStakeTransaction(tx Transaction) error {
+	if tx.Type != TxTypeVote && s.utxo {
+		return fmt.Errorf("%s transactions need the account model", tx.Type)
+	}
+	from := tx.FromAddress
+
+	switch tx.Type {
+	case TxTypeStake:
+		if available := s.balances[from]; tx.Amount+tx.Fee > available {
+			return fmt.Errorf("insufficient balance for %s: %s available, %s requested",
+				formatAddress(from), FormatAmount(available), FormatAmount(tx.Amount+tx.Fee))
+		}
+		s.balances[from] -= tx.Amount + tx.Fee
+		s.stakes[from] += tx.Amount
+		return nil
+
+	case TxTypeUnstake:
+		if staked := s.stakes[from]; tx.Amount > staked {
+			return fmt.Errorf("%s has only %s staked, cannot unstake %s",
+				formatAddress(from), FormatAmount(staked), FormatAmount(tx.Amount))
+		}
+		if s.balances[from]+tx.Amount < tx.Fee {
+			return fmt.Errorf("insufficient balance for %s to pay the fee", formatAddress(from))
+		}
+		s.stakes[from] -= tx.Amount
+		s.balances[from] += tx.Amount - tx.Fee
+		return nil
+
+	case TxTypeEvidence:
+		ev, offender, err := parseEvidence(tx.Payload)
+		if err != nil {
+			return err
+		}
+		if s.slashed[ev.key()] {
+			return fmt.Errorf("this double-sign by %s has already been reported", formatAddress(offender))
+		}
+		if s.stakes[offender] <= 0 {
+			return fmt.Errorf("%s has no stake to slash", formatAddress(offender))
+		}
+		if tx.Fee > s.balances[from] {
+			return fmt.Errorf("insufficient balance for %s to pay the fee", formatAddress(from))
+		}
+		s.balances[from] -= tx.Fee
+		s.stakes[offender] = 0
+		s.slashed[ev.key()] = true
+		return nil
+	}
+	return nil
+}
+
+// applyUTXOTransaction spends the transaction's inputs and adds its outputs
+// to the unspent set.
+func (s *chainState) applyUTXOTransaction(tx Transaction) error {
+	if err := checkUTXOTransaction(tx, s.utxos); err != nil {
+		return err
+	}
+	for _, in := range tx.Inputs {
+		key := outpoint(in.TxID, in.Index)
+		if out, ok := s.utxos[key]; ok {
+			s.balances[out.Address] -= out.Amount
+			delete(s.utxos, key)
+		}
+	}
+	txID := tx.ID()
+	for i, out := range tx.Outputs {
+		s.utxos[outpoint(txID, i)] = out
+		s.balances[out.Address] += out.Amount
+	}
+	return nil
+}
+
+// checkUTXOTransaction verifies that a transaction only spends existing
+// outputs owned by its sender, spends each at most once and creates exactly
+// as much value as it consumes minus its fee. The signed recipient and
+// amount are what the chain displays, so the outputs must agree with them:
+// the first output pays the recipient exactly the amount and any others
+// return change to the sender. Coinbase transactions only need outputs, and
+// a single one matching the recipient if they name one.
+func checkUTXOTransaction(tx Transaction, utxos map[string]TxOutput) error {
+	if len(tx.Outputs) == 0 {
+		return fmt.Errorf("transaction has no outputs")
+	}
+	for _, out := range tx.Outputs {
+		if out.Amount <= 0 {
+			return fmt.Errorf("output amounts must be positive")
+		}
+	}
+	payee := TxOutput{Address: tx.ToAddress, Amount: tx.Amount}
+
+	if tx.FromAddress == "" {
+		if len(tx.Inputs) != 1 || tx.Inputs[0].TxID != "" {
+			return fmt.Errorf("coinbase must have a single height input")
+		}
+		if tx.ToAddress != "" && (len(tx.Outputs) != 1 || tx.Outputs[0] != payee) {
+			return fmt.Errorf("coinbase outputs do not match its recipient and amount")
+		}
+		return nil
+	}
+
+	if tx.Outputs[0] != payee {
+		return fmt.Errorf("first output must pay %s to the recipient %s", FormatAmount(tx.Amount), formatAddress(tx.ToAddress))
+	}
+	for _, out := range tx.Outputs[1:] {
+		if out.Address != tx.FromAddress {
+			return fmt.Errorf("outputs after the first must return change to the sender")
+		}
+	}
+
+	if len(tx.Inputs) == 0 {
+		return fmt.Errorf("transaction has no inputs")
+	}
+	seen := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		key := outpoint(in.TxID, in.Index)
+		if seen[key] {
+			return fmt.Errorf("output %s is spent twice in the same transaction", key)
+		}
+		seen[key] = true
+
+		out, ok := utxos[key]
+		if !ok {
+			return fmt.Errorf("output %s does not exist or is already spent", key)
+		}
+		if out.Address != tx.FromAddress {
+			return fmt.Errorf("output %s is not owned by the sender", key)
+		}
+	}
+
+	if tx.Fee < 0 {
+		return fmt.Errorf("transaction fee must not be negative")
+	}
+	in, out := tx.InputTotal(utxos), tx.OutputTotal()
+	if in != out+tx.Fee {
+		return fmt.Errorf("inputs (%s) do not equal outputs (%s) plus fee (%s)", FormatAmount(in), FormatAmount(out), FormatAmount(tx.Fee))
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckUTXOTransactionOutputsMatchPayee(t *testing.T) {
+	const alice, bob, carol = "alice", "bob", "carol"
+	utxos := map[string]TxOutput{outpoint("funding", 0): {Address: alice, Amount: 50}}
+	spend := []TxInput{{TxID: "funding", Index: 0}}
+
+	tests := []struct {
+		name    string
+		tx      Transaction
+		wantErr string
+	}{
+		{
+			name: "payment with change",
+			tx: Transaction{FromAddress: alice, ToAddress: bob, Amount: 10, Fee: 1, Inputs: spend,
+				Outputs: []TxOutput{{Address: bob, Amount: 10}, {Address: alice, Amount: 39}}},
+		},
+		{
+			name: "first output pays a different amount",
+			tx: Transaction{FromAddress: alice, ToAddress: bob, Amount: 10, Inputs: spend,
+				Outputs: []TxOutput{{Address: bob, Amount: 1}, {Address: alice, Amount: 49}}},
+			wantErr: "first output",
+		},
+		{
+			name: "first output pays someone else",
+			tx: Transaction{FromAddress: alice, ToAddress: bob, Amount: 10, Inputs: spend,
+				Outputs: []TxOutput{{Address: carol, Amount: 10}, {Address: alice, Amount: 40}}},
+			wantErr: "first output",
+		},
+		{
+			name: "extra output to a third party",
+			tx: Transaction{FromAddress: alice, ToAddress: bob, Amount: 10, Inputs: spend,
+				Outputs: []TxOutput{{Address: bob, Amount: 10}, {Address: carol, Amount: 40}}},
+			wantErr: "change to the sender",
+		},
+		{
+			name: "coinbase",
+			tx: Transaction{ToAddress: bob, Amount: 100, Inputs: []TxInput{{Index: 1}},
+				Outputs: []TxOutput{{Address: bob, Amount: 100}}},
+		},
+		{
+			name: "coinbase output differs from its amount",
+			tx: Transaction{ToAddress: bob, Amount: 100, Inputs: []TxInput{{Index: 1}},
+				Outputs: []TxOutput{{Address: bob, Amount: 1000}}},
+			wantErr: "coinbase outputs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErr(t, checkUTXOTransaction(tt.tx, utxos), tt.wantErr)
+		})
+	}
+}
+
+// checkErr fails the test unless err is nil when want is empty, or an error
+// containing want otherwise.
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if want == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("got error %v, want one containing %q", err, want)
+	}
+}
+
+func TestApplyTransactionBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		tx      Transaction
+		wantErr string
+	}{
+		{name: "within the balance", tx: Transaction{FromAddress: "alice", ToAddress: "bob", Amount: 9, Fee: 1}},
+		{
+			name:    "above the balance",
+			tx:      Transaction{FromAddress: "alice", ToAddress: "bob", Amount: 10, Fee: 1},
+			wantErr: "0.00001 available, 0.000011 requested",
+		},
+		{
+			name:    "sender with no coins",
+			tx:      Transaction{FromAddress: "carol", ToAddress: "bob", Amount: 1},
+			wantErr: "0.00 available",
+		},
+		{
+			name:    "zero amount",
+			tx:      Transaction{FromAddress: "alice", ToAddress: "bob", Fee: 1},
+			wantErr: "must be positive",
+		},
+		{name: "mining reward", tx: Transaction{ToAddress: "bob", Amount: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newChainState(ModelAccount)
+			s.balances["alice"] = 10
+			err := s.applyTransaction(tt.tx)
+			checkErr(t, err, tt.wantErr)
+			if err != nil && (s.balances["alice"] != 10 || s.balances["bob"] != 0) {
+				t.Fatalf("rejected transaction changed balances: %v", s.balances)
+			}
+		})
+	}
+}
+
+func TestApplyTransactionNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		nonce   uint64
+		wantErr string
+	}{
+		{name: "next nonce", nonce: 2},
+		{name: "replayed nonce", nonce: 1, wantErr: "nonce 1 already used"},
+		{name: "first nonce replayed", nonce: 0, wantErr: "nonce 0 already used"},
+		{name: "out of order", nonce: 3, wantErr: "nonce 3 out of order"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newChainState(ModelAccount)
+			s.balances["alice"] = 10
+			s.nonces["alice"] = 2
+			tx := Transaction{FromAddress: "alice", ToAddress: "bob", Amount: 1, Nonce: tt.nonce}
+			err := s.applyTransaction(tx)
+			checkErr(t, err, tt.wantErr)
+			want := uint64(2)
+			if err == nil {
+				want = 3
+			}
+			if s.nonces["alice"] != want {
+				t.Fatalf("next nonce is %d, want %d", s.nonces["alice"], want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import "fmt"
+
+// stateIndexVersion is written to state.json. An index saved in another
+// version is rebuilt instead of loaded.
+const stateIndexVersion = 2
+
+// stateIndex is the ledger state after the block at Height, kept up to date
+// as blocks are added so balance lookups do not replay the chain. Alongside
+// it is an address index: for every address, the confirmed transactions
+// that involve it. The index is saved next to the block store and can be
+// rebuilt from the chain at any time.
+type stateIndex struct {
+	Height int
+	Hash   string
+	state  *chainState
+	// history is left nil when the index is read from disk, and read from
+	// the history log the first time it is asked for.
+	history map[string][]HistoryEntry
+	// unsaved holds what each block applied since the last save changed.
+	unsaved []indexedBlock
+	// rewrite marks an index built from genesis, whose files are written
+	// from scratch instead of appended to.
+	rewrite bool
+
+	// Where the index was last saved, and how much of each log it owns.
+	dir         string
+	logSize     int64
+	logBlocks   int
+	historySize int64
+}
+
+// indexedBlock is what applying one block changed in the index.
+type indexedBlock struct {
+	delta   StateDeltaData
+	history HistoryBlockData
+}
+
+// HistoryEntry points at a confirmed transaction involving an address and
+// records how it changed the address's balance.
+type HistoryEntry struct {
+	Height int   `json:"height"`
+	Tx     int   `json:"tx"` // position in the block
+	Change int64 `json:"change"`
+}
+
+// updateStateIndex brings the state index up to the chain's tip. Blocks
+// added since it was last updated are applied to it; if the chain no longer
+// contains the block it was built on, it is rebuilt from genesis. On a chain
+// whose blocks do not apply cleanly the index is dropped and an error
+// returned, and callers fall back to replaying the chain.
+func (bc *Blockchain) updateStateIndex() error {
+	idx := bc.index
+	if idx == nil || idx.Height >= len(bc.Chain) || bc.Chain[idx.Height].Hash != idx.Hash {
+		idx = &stateIndex{
+			Height:  -1,
+			state:   bc.initialState(),
+			history: make(map[string][]HistoryEntry),
+			rewrite: true,
+		}
+		if err := idx.applyBlock(0, bc.Chain[0]); err != nil {
+			bc.index = nil
+			return fmt.Errorf("block 0: %v", err)
+		}
+	}
+	for idx.Height < len(bc.Chain)-1 {
+		height := idx.Height + 1
+		if err := idx.applyBlock(height, bc.Chain[height]); err != nil {
+			bc.index = nil
+			return fmt.Errorf("block %d: %v", height, err)
+		}
+	}
+	bc.index = idx
+	return nil
+}
+
+// applyBlock applies a block's transactions to the index and records them
+// in the history of every address they involve. Unless the index is going
+// to be written from scratch, the state the block touched is kept for the
+// state log.
+func (idx *stateIndex) applyBlock(height int, block Block) error {
+	s := idx.state
+	entries := make(map[string][]HistoryEntry)
+	addresses := make(map[string]bool)
+	outpoints := make(map[string]bool)
+	var slashed []string
+	for i, tx := range block.Transactions() {
+		parties := transactionParties(tx)
+		before := make([]int64, len(parties))
+		for j, addr := range parties {
+			before[j] = s.balances[addr]
+			addresses[addr] = true
+		}
+		for _, in := range tx.Inputs {
+			key := outpoint(in.TxID, in.Index)
+			if out, ok := s.utxos[key]; ok {
+				outpoints[key] = true
+				addresses[out.Address] = true
+			}
+		}
+		if err := s.applyTransaction(tx); err != nil {
+			return err
+		}
+		if s.utxo {
+			txID := tx.ID()
+			for j := range tx.Outputs {
+				outpoints[outpoint(txID, j)] = true
+			}
+		}
+		if tx.Type == TxTypeEvidence {
+			if ev, _, err := parseEvidence(tx.Payload); err == nil {
+				slashed = append(slashed, ev.key())
+			}
+		}
+		for j, addr := range parties {
+			entries[addr] = append(entries[addr], HistoryEntry{
+				Height: height,
+				Tx:     i,
+				Change: s.balances[addr] - before[j],
+			})
+		}
+	}
+
+	if idx.history != nil {
+		for addr, list := range entries {
+			idx.history[addr] = append(idx.history[addr], list...)
+		}
+	}
+	applied := indexedBlock{history: HistoryBlockData{Height: height, Hash: block.Hash, Entries: entries}}
+	if !idx.rewrite {
+		applied.delta = s.delta(addresses, outpoints, slashed)
+	}
+	applied.delta.Height = height
+	applied.delta.Hash = block.Hash
+	applied.delta.PrevHash = idx.Hash
+	idx.unsaved = append(idx.unsaved, applied)
+	idx.Height = height
+	idx.Hash = block.Hash
+	return nil
+}
+
+// delta records the current value of the given addresses and outputs and
+// the slashed double-signs, as a state log line for the block that changed
+// them.
+func (s *chainState) delta(addresses, outpoints map[string]bool, slashed []string) StateDeltaData {
+	d := StateDeltaData{
+		Balances: make(map[string]int64),
+		Nonces:   make(map[string]uint64),
+		Stakes:   make(map[string]int64),
+		Created:  make(map[string]TxOutput),
+	}
+	for addr := range addresses {
+		d.Balances[addr] = s.balances[addr]
+		if nonce, ok := s.nonces[addr]; ok {
+			d.Nonces[addr] = nonce
+		}
+		if stake, ok := s.stakes[addr]; ok {
+			d.Stakes[addr] = stake
+		}
+	}
+	for key := range outpoints {
+		if out, ok := s.utxos[key]; ok {
+			d.Created[key] = out
+		} else {
+			d.Spent = append(d.Spent, key)
+		}
+	}
+	for _, key := range slashed {
+		if s.slashed[key] {
+			d.Slashed = append(d.Slashed, key)
+		}
+	}
+	return d
+}
+
+// applyDelta replays a state log line.
+func (s *chainState) applyDelta(d StateDeltaData) {
+	for addr, balance := range d.Balances {
+		s.balances[addr] = balance
+	}
+	for addr, nonce := range d.Nonces {
+		s.nonces[addr] = nonce
+	}
+	for addr, stake := range d.Stakes {
+		s.stakes[addr] = stake
+	}
+	for _, key := range d.Slashed {
+		s.slashed[key] = true
+	}
+	for _, key := range d.Spent {
+		delete(s.utxos, key)
+	}
+	for key, out := range d.Created {
+		s.utxos[key] = out
+	}
+}
+
+// transactionParties lists the addresses a transaction involves: its sender,
+// its recipient and, on UTXO chains, the owners of its outputs.
+func transactionParties(tx Transaction) []string {
+	parties := []string{}
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			parties = append(parties, addr)
+		}
+	}
+	add(tx.FromAddress)
+	add(tx.ToAddress)
+	for _, out := range tx.Outputs {
+		add(out.Address)
+	}
+	return parties
+}
+
+// RebuildStateIndex discards the state index and builds it again from the
+// chain.
+func (bc *Blockchain) RebuildStateIndex() error {
+	bc.index = nil
+	return bc.updateStateIndex()
+}
+
+// AddressHistory returns the confirmed transactions involving address, in
+// chain order.
+func (bc *Blockchain) AddressHistory(address string) ([]HistoryEntry, error) {
+	if err := bc.updateStateIndex(); err != nil {
+		return nil, fmt.Errorf("chain cannot be indexed: %v", err)
+	}
+	if bc.index.history == nil {
+		// A history log that does not match the state is rebuilt with it.
+		if err := bc.index.loadHistory(); err != nil {
+			if err := bc.RebuildStateIndex(); err != nil {
+				return nil, fmt.Errorf("chain cannot be indexed: %v", err)
+			}
+		}
+	}
+	return bc.index.history[address], nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mineTransfer mines a block paying the reward to miner and including a
+// signed transfer of amount from the key's address to to, if amount is set.
+func mineTransfer(t *testing.T, bc *Blockchain, miner, to string, amount int64) {
+	t.Helper()
+	if amount > 0 {
+		key, _, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, err := addressFromKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Fund the sender first.
+		if _, err := bc.MinePendingTransactions(context.Background(), from); err != nil {
+			t.Fatal(err)
+		}
+		tx := NewTransaction(from, to, amount)
+		tx.Nonce = bc.GetNextNonce(from)
+		tx.signTransaction(key)
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bc.MinePendingTransactions(context.Background(), miner); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateIndexSavedIncrementally(t *testing.T) {
+	dir := t.TempDir()
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	mineTransfer(t, bc, "miner", "", 0)
+	if err := saveChainStore(dir, bc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each later save appends to the logs instead of rewriting the snapshot.
+	snapshot, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		bc, err = loadChainStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mineTransfer(t, bc, "miner", "bob", int64(i+1)*UnitsPerCoin)
+		if err := saveChainStore(dir, bc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(snapshot) {
+		t.Fatalf("state.json was rewritten by saves that only added blocks")
+	}
+	log, err := os.ReadFile(filepath.Join(dir, stateLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(log), "\n"); lines != 6 {
+		t.Fatalf("state.log has %d lines, want one per block added since the snapshot (6)", lines)
+	}
+
+	// An interrupted save leaves a partial line, which the next save replaces.
+	f, err := os.OpenFile(filepath.Join(dir, stateLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"height":`)
+	f.Close()
+	bc, err = loadChainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineTransfer(t, bc, "miner", "carol", UnitsPerCoin)
+	if err := saveChainStore(dir, bc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tip state is read without loading the chain and matches a replay.
+	idx, err := readStateIndex(dir, bc.Model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, hash, err := readStoreTip(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Height != height || idx.Hash != hash || height != len(bc.Chain)-1 {
+		t.Fatalf("saved index at block %d %s, store tip at block %d %s, chain has %d blocks", idx.Height, idx.Hash, height, hash, len(bc.Chain))
+	}
+	replayed, err := bc.replayState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(idx.state, replayed) {
+		t.Fatalf("saved state differs from a replay of the chain:\n saved    %+v\n replayed %+v", idx.state, replayed)
+	}
+	if got := idx.state.balances["bob"]; got != 6*UnitsPerCoin {
+		t.Errorf("bob's balance = %d, want %d", got, 6*UnitsPerCoin)
+	}
+
+	// The address index is read back from history.log.
+	loaded, err := loadChainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := loadChainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuilt.RebuildStateIndex(); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"miner", "bob", "carol"} {
+		got, err := loaded.AddressHistory(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := rebuilt.AddressHistory(addr)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("history of %s = %+v, want %+v", addr, got, want)
+		}
+	}
+	if loaded.index.rewrite {
+		t.Errorf("history.log was not read; the index was rebuilt instead")
+	}
+}
+
+func TestAddressHistoryReadsOnlyItsBlocks(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	mineTransfer(t, bc, "miner", "", 0)
+	mineTransfer(t, bc, "miner", "bob", UnitsPerCoin)
+	if err := saveBlockchain(bc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage block 1, which does not involve bob. His history never reads it.
+	logPath := filepath.Join(getChainDir(), blockLogFile)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines[1] = "x" + lines[1][1:]
+	if err := os.WriteFile(logPath, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, blockAt, done, err := addressHistory("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if len(entries) != 1 || entries[0].Change != UnitsPerCoin {
+		t.Fatalf("bob's history = %+v, want one transfer of %d", entries, UnitsPerCoin)
+	}
+	block, err := blockAt(entries[0].Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx := block.Transactions()[entries[0].Tx]; tx.ToAddress != "bob" {
+		t.Fatalf("entry points at a transaction to %s", tx.ToAddress)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The state index is saved in three files next to the block store:
+//
+//   - state.json, a snapshot of the ledger state after some block,
+//   - state.log, one line per block added since the snapshot with just the
+//     balances, nonces, stakes and outputs that block changed, and
+//   - history.log, one line per block of the chain with the address index
+//     entries it added.
+//
+// Saving after a new block appends a line to each log. Every
+// stateLogCompact blocks the snapshot is rewritten and state.log emptied.
+// An index built from genesis, after a reorganization or by reindex, is
+// written from scratch.
+const stateLogCompact = 1000
+
+// saveStateIndex writes what has changed in the chain's state index since it
+// was loaded or last saved. A chain that cannot be indexed is saved without
+// one.
+func saveStateIndex(dir string, bc *Blockchain) error {
+	if bc.updateStateIndex() != nil {
+		return nil
+	}
+	idx := bc.index
+	if !idx.rewrite && !idx.savedIn(dir) {
+		// The logs in dir do not hold what came before the unsaved
+		// blocks, so they are written from genesis.
+		if bc.RebuildStateIndex() != nil {
+			return nil
+		}
+		idx = bc.index
+	}
+	if idx.rewrite {
+		return idx.writeFiles(dir)
+	}
+	if len(idx.unsaved) == 0 {
+		return nil
+	}
+	return idx.appendFiles(dir)
+}
+
+// savedIn reports whether the index was last saved in dir and its logs there
+// are still at least as long as when it was.
+func (idx *stateIndex) savedIn(dir string) bool {
+	if idx.dir != dir {
+		return false
+	}
+	stateLog, err := os.Stat(filepath.Join(dir, stateLogFile))
+	if err != nil || stateLog.Size() < idx.logSize {
+		return false
+	}
+	history, err := os.Stat(filepath.Join(dir, historyFile))
+	return err == nil && history.Size() >= idx.historySize
+}
+
+// writeFiles writes an index built from genesis: the history log, with a
+// line for every block, and a snapshot of the state.
+func (idx *stateIndex) writeFiles(dir string) error {
+	var history bytes.Buffer
+	for _, b := range idx.unsaved {
+		line, err := json.Marshal(b.history)
+		if err != nil {
+			return err
+		}
+		history.Write(line)
+		history.WriteByte('\n')
+	}
+	if err := writeFileAtomic(filepath.Join(dir, historyFile), history.Bytes(), 0644); err != nil {
+		return err
+	}
+	idx.historySize = int64(history.Len())
+	if err := idx.writeSnapshot(dir); err != nil {
+		return err
+	}
+	idx.dir = dir
+	idx.unsaved = nil
+	idx.rewrite = false
+	return nil
+}
+
+// appendFiles adds the unsaved blocks to the logs. The history log goes
+// first, so a state log line never refers to history that is not on disk.
+func (idx *stateIndex) appendFiles(dir string) error {
+	lines := make([][]byte, len(idx.unsaved))
+	for i, b := range idx.unsaved {
+		line, err := json.Marshal(b.history)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(line, '\n')
+	}
+	sizes, err := appendLog(filepath.Join(dir, historyFile), idx.historySize, lines)
+	if err != nil {
+		return err
+	}
+	for i, b := range idx.unsaved {
+		b.delta.HistorySize = sizes[i]
+		line, err := json.Marshal(b.delta)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(line, '\n')
+	}
+	logSizes, err := appendLog(filepath.Join(dir, stateLogFile), idx.logSize, lines)
+	if err != nil {
+		return err
+	}
+	idx.historySize = sizes[len(sizes)-1]
+	idx.logSize = logSizes[len(logSizes)-1]
+	idx.logBlocks += len(idx.unsaved)
+	idx.unsaved = nil
+	if idx.logBlocks >= stateLogCompact {
+		return idx.writeSnapshot(dir)
+	}
+	return nil
+}
+
+// writeSnapshot writes the state to state.json and empties the state log.
+// Lines left in the log by a crash in between are at or below the
+// snapshot's height, so they are skipped when the index is read.
+func (idx *stateIndex) writeSnapshot(dir string) error {
+	s := idx.state
+	data, err := json.Marshal(StateIndexData{
+		Version:     stateIndexVersion,
+		Height:      idx.Height,
+		Hash:        idx.Hash,
+		Balances:    s.balances,
+		Nonces:      s.nonces,
+		Stakes:      s.stakes,
+		Slashed:     s.slashed,
+		UTXOs:       s.utxos,
+		HistorySize: idx.historySize,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, stateFile), data, 0644); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, stateLogFile), nil, 0644); err != nil {
+		return err
+	}
+	idx.logSize = 0
+	idx.logBlocks = 0
+	return nil
+}
+
+// appendLog writes lines to the log at path after its first size bytes,
+// dropping anything an interrupted save left past them. It returns the
+// log's size after each line.
+func appendLog(path string, size int64, lines [][]byte) ([]int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(lines))
+	for i, line := range lines {
+		if _, err := f.WriteAt(line, size); err != nil {
+			return nil, err
+		}
+		size += int64(len(line))
+		sizes[i] = size
+	}
+	return sizes, f.Sync()
+}
+
+// loadStateIndex reads the saved state index, if there is one for a block
+// on bc's chain. Otherwise the index is rebuilt from the chain when first
+// needed; it is only a cache.
+func loadStateIndex(dir string, bc *Blockchain) {
+	idx, err := readStateIndex(dir, bc.Model)
+	if err != nil || idx.Height < 0 || idx.Height >= len(bc.Chain) || bc.Chain[idx.Height].Hash != idx.Hash {
+		return
+	}
+	bc.index = idx
+}
+
+// readStateIndex reads the snapshot in dir and replays the state log on top
+// of it. The log is read up to its first line that does not follow on from
+// the state so far, which is where the next save appends. The history log
+// is not read.
+func readStateIndex(dir, model string) (*stateIndex, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	var snap StateIndexData
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != stateIndexVersion {
+		return nil, fmt.Errorf("state index version %d is not supported (expected %d)", snap.Version, stateIndexVersion)
+	}
+	s := newChainState(model)
+	for k, v := range snap.Balances {
+		s.balances[k] = v
+	}
+	for k, v := range snap.Nonces {
+		s.nonces[k] = v
+	}
+	for k, v := range snap.Stakes {
+		s.stakes[k] = v
+	}
+	for k, v := range snap.Slashed {
+		s.slashed[k] = v
+	}
+	for k, v := range snap.UTXOs {
+		s.utxos[k] = v
+	}
+	idx := &stateIndex{Height: snap.Height, Hash: snap.Hash, state: s, dir: dir, historySize: snap.HistorySize}
+
+	f, err := os.Open(filepath.Join(dir, stateLogFile))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var d StateDeltaData
+		if json.Unmarshal(line, &d) != nil || d.Height != idx.Height+1 || d.PrevHash != idx.Hash {
+			break
+		}
+		s.applyDelta(d)
+		idx.Height = d.Height
+		idx.Hash = d.Hash
+		idx.historySize = d.HistorySize
+		idx.logSize += int64(len(line))
+		idx.logBlocks++
+	}
+	return idx, nil
+}
+
+// loadHistory reads the address index from the history log, which has a
+// line for every block up to the last save. Blocks applied since are added
+// from memory.
+func (idx *stateIndex) loadHistory() error {
+	if idx.dir == "" {
+		return fmt.Errorf("state index has not been saved")
+	}
+	savedHash := idx.Hash
+	if len(idx.unsaved) > 0 {
+		savedHash = idx.unsaved[0].delta.PrevHash
+	}
+	savedHeight := idx.Height - len(idx.unsaved)
+
+	path := filepath.Join(idx.dir, historyFile)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	history := make(map[string][]HistoryEntry)
+	r := bufio.NewReader(io.NewSectionReader(f, 0, idx.historySize))
+	var last HistoryBlockData
+	height := 0
+	for ; ; height++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s, block %d: %v", path, height, err)
+		}
+		var b HistoryBlockData
+		if err := json.Unmarshal(line, &b); err != nil {
+			return fmt.Errorf("%s, block %d: %v", path, height, err)
+		}
+		if b.Height != height {
+			return fmt.Errorf("%s: expected block %d, found %d", path, height, b.Height)
+		}
+		for addr, entries := range b.Entries {
+			history[addr] = append(history[addr], entries...)
+		}
+		last = b
+	}
+	if height != savedHeight+1 || last.Hash != savedHash {
+		return fmt.Errorf("%s does not end at block %d", path, savedHeight)
+	}
+	for _, b := range idx.unsaved {
+		for addr, entries := range b.history.Entries {
+			history[addr] = append(history[addr], entries...)
+		}
+	}
+	idx.history = history
+	return nil
+}
+
+// readTipState reads the saved state index if it is at the tip of the block
+// store, without decoding any blocks. Commands that only look up current
+// balances use it, and load the chain when it returns false.
+func readTipState() (*stateIndex, ChainMetaData, bool) {
+	dir := getChainDir()
+	var meta ChainMetaData
+	data, err := os.ReadFile(filepath.Join(dir, chainMetaFile))
+	if err != nil || json.Unmarshal(data, &meta) != nil || meta.Version != blockchainFormatVersion {
+		return nil, meta, false
+	}
+	model := meta.Model
+	if model == "" {
+		model = ModelAccount
+	}
+	idx, err := readStateIndex(dir, model)
+	if err != nil {
+		return nil, meta, false
+	}
+	height, hash, err := readStoreTip(dir)
+	if err != nil || idx.Height != height || idx.Hash != hash {
+		return nil, meta, false
+	}
+	return idx, meta, true
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	blockLogFile   = "blocks.log"
+	blockIndexFile = "blocks.idx"
+
+	// indexEntrySize is the size of one record in the index: the block's
+	// offset and length in the log followed by its 32-byte hash.
+	indexEntrySize = 8 + 4 + 32
+)
+
+// BlockStore keeps a chain's blocks on disk in height order.
+type BlockStore interface {
+	// Len returns the number of stored blocks.
+	Len() int
+	// Append stores a block after the current last one.
+	Append(block Block) error
+	// Hash returns the hash of the block at height without reading it.
+	Hash(height int) (string, error)
+	// HeightOf returns the height of the block with the given hash.
+	HeightOf(hash string) (int, bool)
+	// Block reads the block at height.
+	Block(height int) (Block, error)
+	// Each reads the blocks in order, one at a time.
+	Each(fn func(height int, block Block) error) error
+	// Truncate drops every block from height on.
+	Truncate(height int) error
+	Close() error
+}
+
+type indexEntry struct {
+	offset int64
+	length int64
+	hash   string
+}
+
+// fileBlockStore is a BlockStore backed by an append-only log with one JSON
+// block per line, plus a fixed-size index record per block so any height
+// can be found without scanning the log. Appending a block writes one log
+// line and one index record.
+type fileBlockStore struct {
+	logPath string
+	log     *os.File
+	index   *os.File
+	entries []indexEntry
+	heights map[string]int
+}
+
+// openBlockStore opens the store in dir, creating it if needed. Records left
+// half-written by an interrupted append are discarded.
+func openBlockStore(dir string) (*fileBlockStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, blockLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, blockIndexFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	s := &fileBlockStore{logPath: logFile.Name(), log: logFile, index: indexFile, heights: make(map[string]int)}
+	if err := s.readIndex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileBlockStore) readIndex() error {
+	data, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+	logInfo, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	for pos := 0; pos+indexEntrySize <= len(data); pos += indexEntrySize {
+		record := data[pos : pos+indexEntrySize]
+		e := indexEntry{
+			offset: int64(binary.BigEndian.Uint64(record[0:8])),
+			length: int64(binary.BigEndian.Uint32(record[8:12])),
+			hash:   hex.EncodeToString(record[12:]),
+		}
+		if e.offset+e.length > logInfo.Size() {
+			break
+		}
+		s.heights[e.hash] = len(s.entries)
+		s.entries = append(s.entries, e)
+	}
+	if end := s.end(); int64(len(data)) != int64(len(s.entries))*indexEntrySize || logInfo.Size() != end {
+		return s.truncateFiles(len(s.entries))
+	}
+	return nil
+}
+
+// end returns the offset just past the last indexed block in the log.
+func (s *fileBlockStore) end() int64 {
+	if n := len(s.entries); n > 0 {
+		return s.entries[n-1].offset + s.entries[n-1].length
+	}
+	return 0
+}
+
+// truncateFiles cuts the log and index back to the first n blocks.
+func (s *fileBlockStore) truncateFiles(n int) error {
+	end := int64(0)
+	if n > 0 {
+		end = s.entries[n-1].offset + s.entries[n-1].length
+	}
+	if err := s.index.Truncate(int64(n) * indexEntrySize); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(end); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// readStoreTip returns the height and hash of the last block in the store in
+// dir from the last index record, without opening the store or reading the
+// log. A record pointing past the end of the log means the store needs the
+// recovery openBlockStore does, and is an error here.
+func readStoreTip(dir string) (int, string, error) {
+	index, err := os.Open(filepath.Join(dir, blockIndexFile))
+	if err != nil {
+		return 0, "", err
+	}
+	defer index.Close()
+	info, err := index.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	n := info.Size() / indexEntrySize
+	if n == 0 {
+		return 0, "", fmt.Errorf("no blocks")
+	}
+	record := make([]byte, indexEntrySize)
+	if _, err := index.ReadAt(record, (n-1)*indexEntrySize); err != nil {
+		return 0, "", err
+	}
+	logInfo, err := os.Stat(filepath.Join(dir, blockLogFile))
+	if err != nil {
+		return 0, "", err
+	}
+	offset := int64(binary.BigEndian.Uint64(record[0:8]))
+	length := int64(binary.BigEndian.Uint32(record[8:12]))
+	if offset+length > logInfo.Size() {
+		return 0, "", fmt.Errorf("index record for block %d points past the end of the log", n-1)
+	}
+	return int(n - 1), hex.EncodeToString(record[12:]), nil
+}
+
+func (s *fileBlockStore) Len() int {
+	return len(s.entries)
+}
+
+func (s *fileBlockStore) Append(block Block) error {
+	hash, err := hex.DecodeString(block.Hash)
+	if err != nil || len(hash) != 32 {
+		return fmt.Errorf("block %d: malformed hash %q", len(s.entries), block.Hash)
+	}
+	line, err := json.Marshal(blockToData(block))
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	offset := s.end()
+	// The log is written first: an index record never points past the data
+	// it describes, and openBlockStore drops a log line with no record.
+	if _, err := s.log.WriteAt(line, offset); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	record := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(record[0:8], uint64(offset))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(line)))
+	copy(record[12:], hash)
+	if _, err := s.index.WriteAt(record, int64(len(s.entries))*indexEntrySize); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+
+	s.heights[block.Hash] = len(s.entries)
+	s.entries = append(s.entries, indexEntry{offset: offset, length: int64(len(line)), hash: block.Hash})
+	return nil
+}
+
+func (s *fileBlockStore) Hash(height int) (string, error) {
+	if height < 0 || height >= len(s.entries) {
+		return "", fmt.Errorf("no block at height %d", height)
+	}
+	return s.entries[height].hash, nil
+}
+
+func (s *fileBlockStore) HeightOf(hash string) (int, bool) {
+	height, ok := s.heights[hash]
+	return height, ok
+}
+
+func (s *fileBlockStore) Block(height int) (Block, error) {
+	if height < 0 || height >= len(s.entries) {
+		return Block{}, fmt.Errorf("no block at height %d", height)
+	}
+	e := s.entries[height]
+	line := make([]byte, e.length)
+	if _, err := s.log.ReadAt(line, e.offset); err != nil {
+		return Block{}, &LoadError{File: s.logPath, Offset: e.offset, Block: height, Err: err}
+	}
+	return decodeBlockLine(s.logPath, line, e.offset, height)
+}
+
+func (s *fileBlockStore) Each(fn func(height int, block Block) error) error {
+	r := bufio.NewReader(io.NewSectionReader(s.log, 0, s.end()))
+	for height, e := range s.entries {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return &LoadError{File: s.logPath, Offset: e.offset, Block: height, Err: err}
+		}
+		block, err := decodeBlockLine(s.logPath, line, e.offset, height)
+		if err != nil {
+			return err
+		}
+		if err := fn(height, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileBlockStore) Truncate(height int) error {
+	if height < 0 || height > len(s.entries) {
+		return fmt.Errorf("no block at height %d", height)
+	}
+	if err := s.truncateFiles(height); err != nil {
+		return err
+	}
+	for _, e := range s.entries[height:] {
+		delete(s.heights, e.hash)
+	}
+	s.entries = s.entries[:height]
+	return nil
+}
+
+func (s *fileBlockStore) Close() error {
+	err := s.log.Close()
+	if indexErr := s.index.Close(); err == nil {
+		err = indexErr
+	}
+	return err
+}
+
+// decodeBlockLine decodes the log line holding the block at height, which
+// starts at offset in the log at path.
+func decodeBlockLine(path string, line []byte, offset int64, height int) (Block, error) {
+	var bd BlockData
+	if err := decodeJSONNumbers(line, &bd); err != nil {
+		if at, ok := jsonErrorOffset(err); ok {
+			offset += at
+		}
+		return Block{}, &LoadError{File: path, Offset: offset, Block: height, Err: err}
+	}
+	block, err := dataToBlock(bd)
+	if err != nil {
+		return Block{}, &LoadError{File: path, Offset: offset, Block: height, Err: err}
+	}
+	return block, nil
+}
+
+// syncBlockStore makes the store hold exactly chain. Stored blocks that
+// still match the chain are kept, so saving after a new block only appends
+// it, and a reorganization rewrites just the blocks past the fork.
+func syncBlockStore(store BlockStore, chain []Block) error {
+	keep := store.Len()
+	if keep > len(chain) {
+		keep = len(chain)
+	}
+	for keep > 0 {
+		hash, err := store.Hash(keep - 1)
+		if err != nil {
+			return err
+		}
+		if hash == chain[keep-1].Hash {
+			break
+		}
+		keep--
+	}
+	if keep < store.Len() {
+		if err := store.Truncate(keep); err != nil {
+			return err
+		}
+	}
+	for _, block := range chain[keep:] {
+		if err := store.Append(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
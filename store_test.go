@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockStoreRecoversFromInterruptedAppend(t *testing.T) {
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	for i := 0; i < 3; i++ {
+		mineTransfer(t, bc, "miner", "", 0)
+	}
+	last := len(bc.Chain) - 1
+
+	tests := []struct {
+		name       string
+		damage     func(t *testing.T, logPath, indexPath string)
+		wantBlocks int
+	}{
+		{name: "intact", wantBlocks: len(bc.Chain)},
+		{
+			name: "log cut inside the last block",
+			damage: func(t *testing.T, logPath, indexPath string) {
+				truncateBy(t, logPath, 10)
+			},
+			wantBlocks: last,
+		},
+		{
+			name: "index cut inside the last record",
+			damage: func(t *testing.T, logPath, indexPath string) {
+				truncateBy(t, indexPath, indexEntrySize/2)
+			},
+			wantBlocks: last,
+		},
+		{
+			name: "log line with no index record",
+			damage: func(t *testing.T, logPath, indexPath string) {
+				truncateBy(t, indexPath, indexEntrySize)
+			},
+			wantBlocks: last,
+		},
+		{
+			name: "half a record and half a line",
+			damage: func(t *testing.T, logPath, indexPath string) {
+				truncateBy(t, logPath, 1)
+				truncateBy(t, indexPath, 1)
+			},
+			wantBlocks: last,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := saveChainStore(dir, bc); err != nil {
+				t.Fatal(err)
+			}
+			logPath := filepath.Join(dir, blockLogFile)
+			indexPath := filepath.Join(dir, blockIndexFile)
+			if tt.damage != nil {
+				tt.damage(t, logPath, indexPath)
+			}
+
+			store, err := openBlockStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if store.Len() != tt.wantBlocks {
+				t.Fatalf("recovered %d blocks, want %d", store.Len(), tt.wantBlocks)
+			}
+			// The files are cut back to the blocks that were kept.
+			if size := fileSize(t, indexPath); size != int64(tt.wantBlocks)*indexEntrySize {
+				t.Errorf("index is %d bytes, want %d", size, tt.wantBlocks*indexEntrySize)
+			}
+			if size := fileSize(t, logPath); size != store.end() {
+				t.Errorf("log is %d bytes, want %d", size, store.end())
+			}
+			if height, _, err := readStoreTip(dir); err != nil || height != tt.wantBlocks-1 {
+				t.Errorf("store tip = %d, %v; want %d", height, err, tt.wantBlocks-1)
+			}
+			err = store.Each(func(height int, block Block) error {
+				if block.Hash != bc.Chain[height].Hash {
+					t.Errorf("block %d has hash %s, want %s", height, block.Hash, bc.Chain[height].Hash)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The lost block is appended again where it belongs.
+			if err := syncBlockStore(store, bc.Chain); err != nil {
+				t.Fatal(err)
+			}
+			block, err := store.Block(last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Hash != bc.Chain[last].Hash {
+				t.Fatalf("block %d after resync has hash %s, want %s", last, block.Hash, bc.Chain[last].Hash)
+			}
+		})
+	}
+}
+
+func TestReadStoreTipRejectsCutLog(t *testing.T) {
+	dir := t.TempDir()
+	bc := NewBlockchain(1, 50*UnitsPerCoin)
+	mineTransfer(t, bc, "miner", "", 0)
+	if err := saveChainStore(dir, bc); err != nil {
+		t.Fatal(err)
+	}
+	truncateBy(t, filepath.Join(dir, blockLogFile), 1)
+	checkErr(t, func() error { _, _, err := readStoreTip(dir); return err }(), "past the end of the log")
+}
+
+// truncateBy cuts n bytes off the end of the file at path.
+func truncateBy(t *testing.T, path string, n int64) {
+	t.Helper()
+	if err := os.Truncate(path, fileSize(t, path)-n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
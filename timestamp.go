@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// medianTimeSpan is how many preceding blocks the median time past is taken
+// over, as in Bitcoin.
+const medianTimeSpan = 11
+
+// maxFutureDrift is how many seconds ahead of the local clock a block's
+// timestamp may be.
+const maxFutureDrift = 2 * 60 * 60
+
+// MedianTimePast returns the median timestamp of the up to medianTimeSpan
+// blocks before height. Unlike the previous block's timestamp alone, a single
+// miner cannot move it far by lying about the time.
+func (bc *Blockchain) MedianTimePast(height int) int64 {
+	first := height - medianTimeSpan
+	if first < 0 {
+		first = 0
+	}
+	times := make([]int64, 0, height-first)
+	for _, block := range bc.Chain[first:height] {
+		times = append(times, block.TimeStamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// checkTimestamp rejects a block at height whose timestamp is not after the
+// median time past or is more than maxFutureDrift seconds past now.
+func (bc *Blockchain) checkTimestamp(height int, now int64) error {
+	ts := bc.Chain[height].TimeStamp
+	if mtp := bc.MedianTimePast(height); ts <= mtp {
+		return fmt.Errorf("timestamp %s is not after the median time past %s",
+			formatTimestamp(ts), formatTimestamp(mtp))
+	}
+	if ts > now+maxFutureDrift {
+		return fmt.Errorf("timestamp %s is more than %v in the future",
+			formatTimestamp(ts), time.Duration(maxFutureDrift)*time.Second)
+	}
+	return nil
+}
+
+// nextTimestamp returns the timestamp for a new block: the current time, or
+// one second past the median time past if the clock is behind it.
+func (bc *Blockchain) nextTimestamp() int64 {
+	now := time.Now().Unix()
+	if min := bc.MedianTimePast(len(bc.Chain)) + 1; now < min {
+		return min
+	}
+	return now
+}
+
+func formatTimestamp(ts int64) string {
+	return fmt.Sprintf("%d (%s)", ts, time.Unix(ts, 0).UTC().Format("2006-01-02 15:04:05 UTC"))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// chainWithTimes returns a chain whose blocks carry the given timestamps.
+// Only the timestamps are filled in.
+func chainWithTimes(times ...int64) *Blockchain {
+	bc := &Blockchain{}
+	for _, ts := range times {
+		bc.Chain = append(bc.Chain, Block{TimeStamp: ts})
+	}
+	return bc
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	const now = 1_000_000
+	eleven := []int64{100, 101, 102, 103, 104, 105, 106, 107, 108, 109, 110}
+
+	tests := []struct {
+		name    string
+		times   []int64 // the chain before the block
+		ts      int64
+		wantErr string
+	}{
+		{name: "after the median", times: eleven, ts: 106},
+		{name: "at the median", times: eleven, ts: 105, wantErr: "not after the median time past 105"},
+		{name: "below the median", times: eleven, ts: 50, wantErr: "not after the median time past"},
+		{name: "before the previous block but after the median", times: eleven, ts: 107},
+		{name: "median of fewer blocks", times: []int64{100, 300, 200}, ts: 200, wantErr: "median time past 200"},
+		{name: "one outlier does not move the median", times: append(eleven[1:], now), ts: 107},
+		{name: "only the last eleven blocks count", times: append([]int64{900_000}, eleven...), ts: 106},
+		{name: "at the future limit", times: eleven, ts: now + maxFutureDrift},
+		{name: "past the future limit", times: eleven, ts: now + maxFutureDrift + 1, wantErr: "in the future"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := chainWithTimes(append(append([]int64(nil), tt.times...), tt.ts)...)
+			checkErr(t, bc.checkTimestamp(len(tt.times), now), tt.wantErr)
+		})
+	}
+}
+
+func TestNextTimestampPassesMedianTimePast(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name  string
+		times []int64
+		min   int64
+	}{
+		{name: "clock ahead of the chain", times: []int64{now - 30, now - 20, now - 10}, min: now},
+		{name: "chain ahead of the clock", times: []int64{now + 100, now + 200, now + 300}, min: now + 201},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := chainWithTimes(tt.times...)
+			ts := bc.nextTimestamp()
+			if ts < tt.min {
+				t.Fatalf("next timestamp %d, want at least %d", ts, tt.min)
+			}
+			bc.Chain = append(bc.Chain, Block{TimeStamp: ts})
+			if err := bc.checkTimestamp(len(bc.Chain)-1, time.Now().Unix()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -2,35 +2,139 @@ package main
 
 import (
 	"crypto"
-	"crypto/ecdh"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/big"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Transaction struct {
 	FromAddress string
 	ToAddress   string
-	Amount      float64
+	Amount      int64
+	Fee         int64
+	Nonce       uint64
+	Timestamp   int64
+	Inputs      []TxInput
+	Outputs     []TxOutput
+	Type        string
+	Payload     string
 	Signature   []byte
 }
 
-func NewTransaction(from, to string, amount float64) Transaction {
+// Transaction types. Ordinary transfers have no type. A vote is cast by a
+// proof-of-authority signer: ToAddress is the candidate and Payload is
+// VoteAdd or VoteRemove. Votes move no coins. Stake and unstake move Amount
+// from a proof-of-stake validator's balance into its stake and back; both are
+// sent to the validator itself. Evidence carries a DoubleSignEvidence payload
+// and is addressed to the offender, whose stake it burns.
+const (
+	TxTypeVote     = "vote"
+	TxTypeStake    = "stake"
+	TxTypeUnstake  = "unstake"
+	TxTypeEvidence = "evidence"
+
+	VoteAdd    = "add"
+	VoteRemove = "remove"
+)
+
+// TxInput spends an output of an earlier transaction, identified by that
+// transaction's hash and the output's position. A coinbase input has an
+// empty TxID and stores the block height in Index so every coinbase hashes
+// differently.
+type TxInput struct {
+	TxID  string `json:"txid"`
+	Index int    `json:"index"`
+}
+
+// TxOutput assigns an amount to an address. Outputs are only used by chains
+// running the UTXO model.
+type TxOutput struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+func NewTransaction(from, to string, amount int64) Transaction {
 	return Transaction{
 		FromAddress: from,
 		ToAddress:   to,
 		Amount:      amount,
+		Timestamp:   time.Now().Unix(),
 	}
 }
 
 func (t *Transaction) calculateHash() string {
-	data := t.FromAddress + t.ToAddress + fmt.Sprintf("%.6f", t.Amount)
+	data := t.FromAddress + t.ToAddress + fmt.Sprintf("%s|fee:%s|nonce:%d|ts:%d", canonicalAmount(t.Amount), canonicalAmount(t.Fee), t.Nonce, t.Timestamp)
+	for _, in := range t.Inputs {
+		data += fmt.Sprintf("|in:%s:%d", in.TxID, in.Index)
+	}
+	for _, out := range t.Outputs {
+		data += fmt.Sprintf("|out:%s:%s", out.Address, canonicalAmount(out.Amount))
+	}
+	if t.Type != "" {
+		data += fmt.Sprintf("|type:%s|payload:%s", t.Type, t.Payload)
+	}
 	return calculateSHA256(data)
 }
 
+// ID returns the transaction's identifier: the hash of the contents covered
+// by its signature. Coinbase transactions carry the block height in their
+// nonce, so each one gets a distinct ID.
+func (t *Transaction) ID() string {
+	return t.calculateHash()
+}
+
+// Size returns the length of the transaction's serialized form in bytes,
+// which is what counts against a block's size limit.
+func (t *Transaction) Size() int {
+	data, err := json.Marshal(transactionsToData([]Transaction{*t}))
+	if err != nil {
+		return 0
+	}
+	return len(data) - 2 // without the surrounding array brackets
+}
+
+// outpoint returns the key used to address one of the transaction's outputs
+// in the unspent output set.
+func outpoint(txID string, index int) string {
+	return fmt.Sprintf("%s:%d", txID, index)
+}
+
+// parseOutpoint is the inverse of outpoint.
+func parseOutpoint(key string) (TxInput, error) {
+	sep := strings.LastIndex(key, ":")
+	if sep < 0 {
+		return TxInput{}, fmt.Errorf("invalid outpoint %q", key)
+	}
+	index, err := strconv.Atoi(key[sep+1:])
+	if err != nil {
+		return TxInput{}, fmt.Errorf("invalid outpoint %q", key)
+	}
+	return TxInput{TxID: key[:sep], Index: index}, nil
+}
+
+// InputTotal and OutputTotal sum the values on either side of a UTXO
+// transaction. utxos must hold the outputs being spent.
+func (t *Transaction) InputTotal(utxos map[string]TxOutput) int64 {
+	var total int64
+	for _, in := range t.Inputs {
+		total += utxos[outpoint(in.TxID, in.Index)].Amount
+	}
+	return total
+}
+
+func (t *Transaction) OutputTotal() int64 {
+	var total int64
+	for _, out := range t.Outputs {
+		total += out.Amount
+	}
+	return total
+}
+
 func (t *Transaction) signTransaction(signingKey *ecdsa.PrivateKey) {
 	// Convert ECDSA public key to ECDH to get the encoded bytes (non-deprecated)
 	ecdhKey, err := signingKey.PublicKey.ECDH()
@@ -70,33 +174,33 @@ func (t *Transaction) isValid() (bool, error) {
 		return false, fmt.Errorf("no signature in this transaction")
 	}
 
-	publicKeyBytes, err := hex.DecodeString(t.FromAddress)
-	if err != nil {
-		return false, fmt.Errorf("error decoding public key: %v", err)
-	}
-
-	ecdhPubKey, err := ecdh.P256().NewPublicKey(publicKeyBytes)
-	if err != nil {
-		return false, fmt.Errorf("invalid public key: %v", err)
+	if err := verifyHashSignature(t.FromAddress, t.calculateHash(), t.Signature); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	// Extract X and Y coordinates from the ECDH public key bytes
-	// Format: [0x04 || X (32 bytes) || Y (32 bytes)] for uncompressed P256
-	keyBytes := ecdhPubKey.Bytes()
-	x := new(big.Int).SetBytes(keyBytes[1:33])
-	y := new(big.Int).SetBytes(keyBytes[33:65])
-
-	publicKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+// legacySigningHash is what transactions were signed over before they had
+// nonces, timestamps or fees: the sender, the recipient and the amount.
+func (t *Transaction) legacySigningHash() string {
+	return calculateSHA256(t.FromAddress + t.ToAddress + canonicalAmount(t.Amount))
+}
 
-	hashTx := t.calculateHash()
-	hashBytes, err := hex.DecodeString(hashTx)
-	if err != nil {
-		return false, fmt.Errorf("error decoding hash: %v", err)
+// isValidLegacy checks a transaction carried over from a chain created
+// before nonces existed. Its signature covers only the sender, recipient and
+// amount, so nothing else it holds may move coins.
+func (t *Transaction) isValidLegacy() (bool, error) {
+	if t.FromAddress == "" {
+		return true, nil // Mining reward
 	}
-
-	valid := ecdsa.VerifyASN1(&publicKey, hashBytes, t.Signature)
-	if !valid {
-		return false, fmt.Errorf("invalid transaction signature")
+	if t.Fee != 0 || len(t.Inputs) > 0 || len(t.Outputs) > 0 || t.Type != "" {
+		return false, fmt.Errorf("legacy transaction carries fields its signature does not cover")
+	}
+	if len(t.Signature) == 0 {
+		return false, fmt.Errorf("no signature in this transaction")
+	}
+	if err := verifyHashSignature(t.FromAddress, t.legacySigningHash(), t.Signature); err != nil {
+		return false, err
 	}
 	return true, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTransactionTimestamp(t *testing.T) {
+	before := time.Now().Unix()
+	tx := NewTransaction("alice", "bob", 1)
+	after := time.Now().Unix()
+	if tx.Timestamp < before || tx.Timestamp > after {
+		t.Fatalf("timestamp %d is outside %d to %d", tx.Timestamp, before, after)
+	}
+}
+
+func TestTransactionIDCoversSignedContents(t *testing.T) {
+	key, alice := testKey(t)
+	base := signedTransfer(key, alice, "bob", UnitsPerCoin, 10, 3)
+	id := base.ID()
+	if len(id) != 64 {
+		t.Fatalf("ID %q is not a hex SHA-256 hash", id)
+	}
+
+	tests := []struct {
+		name   string
+		change func(tx *Transaction)
+		sameID bool
+	}{
+		{name: "nothing", change: func(tx *Transaction) {}, sameID: true},
+		{name: "signature", change: func(tx *Transaction) { tx.signTransaction(key) }, sameID: true},
+		{name: "recipient", change: func(tx *Transaction) { tx.ToAddress = "carol" }},
+		{name: "amount", change: func(tx *Transaction) { tx.Amount++ }},
+		{name: "fee", change: func(tx *Transaction) { tx.Fee++ }},
+		{name: "nonce", change: func(tx *Transaction) { tx.Nonce++ }},
+		{name: "timestamp", change: func(tx *Transaction) { tx.Timestamp++ }},
+		{name: "type", change: func(tx *Transaction) { tx.Type = TxTypeStake }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := base
+			tt.change(&tx)
+			if got := tx.ID(); (got == id) != tt.sameID {
+				t.Fatalf("ID after changing the %s is %s, was %s", tt.name, got, id)
+			}
+		})
+	}
+
+	// The ID survives the saved form.
+	loaded := dataToTransactions(transactionsToData([]Transaction{base}))[0]
+	if loaded.ID() != id {
+		t.Fatalf("ID after a save and load is %s, want %s", loaded.ID(), id)
+	}
+}
+
+func TestFindTransaction(t *testing.T) {
+	bc, key, addr := fundedChain(t)
+	var sent []Transaction
+	for i := 0; i < 17; i++ {
+		tx := signedTransfer(key, addr, "bob", int64(i+1), 0, uint64(i))
+		if err := bc.AddTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, tx)
+	}
+	if _, err := bc.MinePendingTransactions(context.Background(), "miner"); err != nil {
+		t.Fatal(err)
+	}
+	pending := signedTransfer(key, addr, "bob", UnitsPerCoin, 0, uint64(len(sent)))
+	if err := bc.AddTransaction(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	// Of 17 IDs, two start with the same hex digit.
+	var ambiguous string
+	seen := make(map[byte]bool)
+	for _, tx := range sent {
+		if c := tx.ID()[0]; seen[c] {
+			ambiguous = string(c)
+			break
+		} else {
+			seen[c] = true
+		}
+	}
+
+	want := sent[5].ID()
+	tests := []struct {
+		name    string
+		id      string
+		wantErr string
+	}{
+		{name: "full ID", id: want},
+		{name: "prefix", id: want[:8]},
+		{name: "unknown", id: strings.Repeat("f", 64), wantErr: "not found in the chain"},
+		{name: "ambiguous prefix", id: ambiguous, wantErr: "is ambiguous"},
+		{name: "pending", id: pending.ID(), wantErr: "not found in the chain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, height, index, err := bc.FindTransaction(tt.id)
+			checkErr(t, err, tt.wantErr)
+			if err == nil && (tx.ID() != want || height != 2 || index != 6) {
+				t.Fatalf("found %s at block %d, position %d; want %s at block 2, position 6", tx.ID(), height, index, want)
+			}
+		})
+	}
+
+	if tx, err := bc.FindPendingTransaction(pending.ID()[:8]); err != nil || tx.ID() != pending.ID() {
+		t.Fatalf("pending lookup = %s, %v; want %s", tx.ID(), err, pending.ID())
+	}
+}
+
+func TestTxShow(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	bc, key, addr := fundedChain(t)
+	confirmed := signedTransfer(key, addr, "bob", UnitsPerCoin, 0, 0)
+	if err := bc.AddTransaction(confirmed); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := bc.MinePendingTransactions(context.Background(), "miner"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := signedTransfer(key, addr, "bob", 2*UnitsPerCoin, 0, 1)
+	if err := bc.AddTransaction(pending); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBlockchain(bc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		want   []string
+		absent []string
+	}{
+		{
+			name: "confirmed",
+			id:   confirmed.ID()[:8],
+			want: []string{"ID: " + confirmed.ID(), "Status: confirmed", "Block: #2 ", "Confirmations: 3", "Amount: 1.00 coins", "Nonce: 0"},
+		},
+		{
+			name:   "pending",
+			id:     pending.ID(),
+			want:   []string{"ID: " + pending.ID(), "Status: pending", "Amount: 2.00 coins", "Nonce: 1"},
+			absent: []string{"Block:", "Confirmations:"},
+		},
+		{
+			name: "unknown",
+			id:   "ffffffff",
+			want: []string{"[ERROR] transaction ffffffff not found in the chain"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureOutput(t, func() { txShowCmd.Run(txShowCmd, []string{tt.id}) })
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output does not contain %q:\n%s", want, out)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(out, absent) {
+					t.Errorf("output contains %q:\n%s", absent, out)
+				}
+			}
+		})
+	}
+}
+
+var terminalCodes = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// captureOutput runs fn and returns what it printed, without colors and with
+// runs of spaces collapsed.
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+	fn()
+	w.Close()
+	out := terminalCodes.ReplaceAllString(string(<-output), "")
+	return regexp.MustCompile(" +").ReplaceAllString(out, " ")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// applyBlockToUTXOSet updates the maintained unspent output set with a block
+// that has already been validated.
+func (bc *Blockchain) applyBlockToUTXOSet(block Block) {
+	state := &chainState{utxo: true, utxos: bc.UTXOSet, balances: make(map[string]int64)}
+	for _, tx := range block.Transactions() {
+		state.applyUTXOTransaction(tx)
+	}
+}
+
+// RebuildUTXOSet recomputes the unspent output set from scratch by replaying
+// every block in the chain.
+func (bc *Blockchain) RebuildUTXOSet() error {
+	state := newChainState(ModelUTXO)
+	for i, block := range bc.Chain {
+		for _, tx := range block.Transactions() {
+			if err := state.applyUTXOTransaction(tx); err != nil {
+				return fmt.Errorf("block %d: %v", i, err)
+			}
+		}
+	}
+	bc.UTXOSet = state.utxos
+	return nil
+}
+
+// pendingSpends returns the outpoints consumed by transactions in the
+// pending pool.
+func (bc *Blockchain) pendingSpends() map[string]bool {
+	spent := make(map[string]bool)
+	for _, tx := range bc.PendingTransactions {
+		for _, in := range tx.Inputs {
+			spent[outpoint(in.TxID, in.Index)] = true
+		}
+	}
+	return spent
+}
+
+// utxoBalance sums the unspent outputs owned by address, skipping any
+// outpoints listed in exclude.
+func (bc *Blockchain) utxoBalance(address string, exclude map[string]bool) int64 {
+	var balance int64
+	for key, out := range bc.UTXOSet {
+		if out.Address == address && !exclude[key] {
+			balance += out.Amount
+		}
+	}
+	return balance
+}
+
+// NewUTXOTransaction builds an unsigned transaction paying amount to the
+// recipient from the sender's confirmed unspent outputs. Outputs already
+// spent by pending transactions are skipped, and any surplus beyond the
+// amount and fee is returned to the sender as a change output.
+func (bc *Blockchain) NewUTXOTransaction(from, to string, amount, fee int64) (Transaction, error) {
+	pendingSpends := bc.pendingSpends()
+
+	keys := make([]string, 0, len(bc.UTXOSet))
+	for key, out := range bc.UTXOSet {
+		if out.Address == from && !pendingSpends[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	tx := NewTransaction(from, to, amount)
+	tx.Fee = fee
+	needed := amount + fee
+	var gathered int64
+	for _, key := range keys {
+		if gathered >= needed {
+			break
+		}
+		in, err := parseOutpoint(key)
+		if err != nil {
+			return Transaction{}, err
+		}
+		tx.Inputs = append(tx.Inputs, in)
+		gathered += bc.UTXOSet[key].Amount
+	}
+
+	if gathered < needed {
+		return Transaction{}, fmt.Errorf("insufficient balance: %s available, %s requested", FormatAmount(gathered), FormatAmount(needed))
+	}
+
+	tx.Outputs = []TxOutput{{Address: to, Amount: amount}}
+	if change := gathered - needed; change > 0 {
+		tx.Outputs = append(tx.Outputs, TxOutput{Address: from, Amount: change})
+	}
+	return tx, nil
+}
+
+func sameUTXOSet(a, b map[string]TxOutput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, out := range a {
+		if b[key] != out {
+			return false
+		}
+	}
+	return true
+}